@@ -0,0 +1,174 @@
+// Package capture records packets from a network interface into pcap files
+// using AF_PACKET sockets, without libpcap.
+package capture
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// linktypeLinuxSLL is the "Linux cooked" link type tcpdump uses for
+	// -i any. It works for interfaces with and without Ethernet headers.
+	linktypeLinuxSLL = 113
+	sllHeaderLen     = 16
+
+	// MaxSnaplen keeps records, packet plus cooked header, within the
+	// 262144 bytes libpcap accepts.
+	MaxSnaplen = 262144 - sllHeaderLen
+
+	pollInterval = 200 * time.Millisecond
+)
+
+// Limits bound a capture. It stops at whichever is reached first, or when
+// its context is done. Zero means no limit.
+type Limits struct {
+	Packets int
+	Bytes   int64
+}
+
+// Stats describe a finished capture. Bytes is the size of the pcap file.
+type Stats struct {
+	Packets int
+	Bytes   int64
+}
+
+// Handle is a packet socket bound to one interface.
+type Handle struct {
+	fd      int
+	snaplen int
+}
+
+// Open binds a packet socket to the named interface and attaches filter,
+// a program from Compile, to it. Packets are truncated to snaplen bytes,
+// at most MaxSnaplen. It needs CAP_NET_RAW.
+func Open(iface string, filter []bpf.RawInstruction, snaplen int) (*Handle, error) {
+	if snaplen < 1 || snaplen > MaxSnaplen {
+		return nil, fmt.Errorf("snaplen must be between 1 and %d", MaxSnaplen)
+	}
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, err
+	}
+	// The socket receives nothing until it is bound with a protocol, so no
+	// packet gets past before the filter is attached.
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("packet socket: %w", err)
+	}
+	h := &Handle{fd: fd, snaplen: snaplen}
+
+	if len(filter) > 0 {
+		prog := make([]unix.SockFilter, len(filter))
+		for i, ins := range filter {
+			prog[i] = unix.SockFilter{Code: ins.Op, Jt: ins.Jt, Jf: ins.Jf, K: ins.K}
+		}
+		fprog := unix.SockFprog{Len: uint16(len(prog)), Filter: &prog[0]}
+		if err := unix.SetsockoptSockFprog(fd, unix.SOL_SOCKET, unix.SO_ATTACH_FILTER, &fprog); err != nil {
+			h.Close()
+			return nil, fmt.Errorf("attaching filter: %w", err)
+		}
+	}
+
+	tv := unix.NsecToTimeval(pollInterval.Nanoseconds())
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+		h.Close()
+		return nil, err
+	}
+	if err := unix.Bind(fd, &unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_ALL), Ifindex: ifi.Index}); err != nil {
+		h.Close()
+		return nil, fmt.Errorf("binding to %s: %w", iface, err)
+	}
+	return h, nil
+}
+
+// WriteTo writes a pcap file with the packets received until ctx is done
+// or a limit is reached.
+func (h *Handle) WriteTo(ctx context.Context, w io.Writer, limits Limits) (Stats, error) {
+	out := bufio.NewWriter(w)
+	var stats Stats
+
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	// Records carry the cooked header on top of the packet.
+	binary.LittleEndian.PutUint32(header[16:], uint32(h.snaplen+sllHeaderLen))
+	binary.LittleEndian.PutUint32(header[20:], linktypeLinuxSLL)
+	if _, err := out.Write(header); err != nil {
+		return stats, err
+	}
+	stats.Bytes = int64(len(header))
+
+	buf := make([]byte, h.snaplen)
+	record := make([]byte, 16+sllHeaderLen)
+	for ctx.Err() == nil {
+		if limits.Packets > 0 && stats.Packets >= limits.Packets {
+			break
+		}
+		// MSG_TRUNC returns the length of the packet rather than of the
+		// part that fit into buf.
+		n, from, err := unix.Recvfrom(h.fd, buf, unix.MSG_TRUNC)
+		if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EINTR) {
+			continue
+		}
+		if err != nil {
+			out.Flush()
+			return stats, err
+		}
+		sa, ok := from.(*unix.SockaddrLinklayer)
+		if !ok {
+			continue
+		}
+		captured := min(n, len(buf))
+		size := int64(len(record) + captured)
+		if limits.Bytes > 0 && stats.Bytes+size > limits.Bytes {
+			break
+		}
+
+		now := time.Now()
+		binary.LittleEndian.PutUint32(record[0:], uint32(now.Unix()))
+		binary.LittleEndian.PutUint32(record[4:], uint32(now.Nanosecond()/1000))
+		binary.LittleEndian.PutUint32(record[8:], uint32(sllHeaderLen+captured))
+		binary.LittleEndian.PutUint32(record[12:], uint32(sllHeaderLen+n))
+
+		// The cooked header is big endian; Protocol is already in network
+		// byte order.
+		sll := record[16:]
+		binary.BigEndian.PutUint16(sll[0:], uint16(sa.Pkttype))
+		binary.BigEndian.PutUint16(sll[2:], sa.Hatype)
+		binary.BigEndian.PutUint16(sll[4:], uint16(sa.Halen))
+		clear(sll[6:14])
+		copy(sll[6:14], sa.Addr[:min(int(sa.Halen), 8)])
+		binary.NativeEndian.PutUint16(sll[14:], sa.Protocol)
+
+		if _, err := out.Write(record); err != nil {
+			return stats, err
+		}
+		if _, err := out.Write(buf[:captured]); err != nil {
+			return stats, err
+		}
+		stats.Packets++
+		stats.Bytes += size
+	}
+	return stats, out.Flush()
+}
+
+func (h *Handle) Close() error {
+	return unix.Close(h.fd)
+}
+
+func htons(v uint16) uint16 {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return binary.NativeEndian.Uint16(b)
+}
@@ -0,0 +1,472 @@
+package capture
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/bpf"
+)
+
+// Packets reach the filter without their link layer header, so the
+// ethertype comes from the socket buffer and offsets start at the network
+// header.
+const (
+	etherIPv4 = 0x0800
+	etherIPv6 = 0x86dd
+	etherARP  = 0x0806
+
+	protoICMP   = 1
+	protoTCP    = 6
+	protoUDP    = 17
+	protoICMPv6 = 58
+	protoSCTP   = 132
+)
+
+type direction int
+
+const (
+	dirSrc direction = iota
+	dirDst
+)
+
+type (
+	andNode   struct{ a, b node }
+	orNode    struct{ a, b node }
+	notNode   struct{ a node }
+	etherNode struct{ ethertype uint32 }
+	protoNode struct {
+		proto uint32
+		ipv4  bool
+		ipv6  bool
+	}
+	netNode struct {
+		dir direction
+		net *net.IPNet
+	}
+	portNode struct {
+		dir    direction
+		port   uint32
+		protos []uint32
+	}
+)
+
+type node interface{}
+
+// Compile turns a filter expression in a subset of the tcpdump syntax into
+// a BPF program. It understands ip, ip6, arp, tcp, udp, icmp and icmp6,
+// [src|dst] host, net and port, each optionally qualified by tcp, udp or
+// sctp, and, or, not (also &&, || and !) and parentheses. An empty
+// expression accepts every packet.
+//
+// Accepted packets are passed on whole: truncating them in the filter would
+// hide their original length from the reader.
+func Compile(expr string) ([]bpf.RawInstruction, error) {
+	for _, op := range []string{"(", ")", "&&", "||", "!"} {
+		expr = strings.ReplaceAll(expr, op, " "+op+" ")
+	}
+	p := &parser{tokens: strings.Fields(expr)}
+	if len(p.tokens) == 0 {
+		return nil, nil
+	}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q in filter", p.tokens[p.pos])
+	}
+
+	c := &compiler{labels: make(map[label]int)}
+	accept, reject := c.newLabel(), c.newLabel()
+	c.gen(root, accept, reject)
+	c.place(accept)
+	c.emit(bpf.RetConstant{Val: math.MaxUint32})
+	c.place(reject)
+	c.emit(bpf.RetConstant{Val: 0})
+	return c.assemble()
+}
+
+type parser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *parser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *parser) next() (string, error) {
+	if p.pos >= len(p.tokens) {
+		return "", errors.New("unexpected end of filter")
+	}
+	p.pos++
+	return p.tokens[p.pos-1], nil
+}
+
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	for err == nil && (p.peek() == "or" || p.peek() == "||") {
+		p.pos++
+		var right node
+		if right, err = p.parseAnd(); err == nil {
+			left = orNode{left, right}
+		}
+	}
+	return left, err
+}
+
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseUnary()
+	for err == nil && (p.peek() == "and" || p.peek() == "&&") {
+		p.pos++
+		var right node
+		if right, err = p.parseUnary(); err == nil {
+			left = andNode{left, right}
+		}
+	}
+	return left, err
+}
+
+func (p *parser) parseUnary() (node, error) {
+	switch p.peek() {
+	case "not", "!":
+		p.pos++
+		n, err := p.parseUnary()
+		return notNode{n}, err
+	case "(":
+		p.pos++
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if tok, err := p.next(); err != nil || tok != ")" {
+			return nil, errors.New("missing ) in filter")
+		}
+		return n, nil
+	}
+	return p.parsePrimitive()
+}
+
+func (p *parser) parsePrimitive() (node, error) {
+	tok, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+
+	var protos []uint32
+	switch tok {
+	case "ip":
+		return etherNode{etherIPv4}, nil
+	case "ip6":
+		return etherNode{etherIPv6}, nil
+	case "arp":
+		return etherNode{etherARP}, nil
+	case "icmp":
+		return protoNode{protoICMP, true, false}, nil
+	case "icmp6":
+		return protoNode{protoICMPv6, false, true}, nil
+	case "tcp", "udp", "sctp":
+		proto := map[string]uint32{"tcp": protoTCP, "udp": protoUDP, "sctp": protoSCTP}[tok]
+		switch p.peek() {
+		case "port", "src", "dst", "host", "net":
+		default:
+			return protoNode{proto, true, true}, nil
+		}
+		protos = []uint32{proto}
+		tok, _ = p.next()
+	}
+
+	dirs := []direction{dirSrc, dirDst}
+	if tok == "src" || tok == "dst" {
+		if tok == "src" {
+			dirs = []direction{dirSrc}
+		} else {
+			dirs = []direction{dirDst}
+		}
+		if tok, err = p.next(); err != nil {
+			return nil, err
+		}
+	}
+
+	var build func(direction) node
+	var qualifier node
+	switch tok {
+	case "host", "net":
+		// As in tcpdump, "tcp host h" is "tcp and host h".
+		if protos != nil {
+			qualifier = protoNode{protos[0], true, true}
+		}
+		arg, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		ipnet, err := parseNet(arg, tok == "host")
+		if err != nil {
+			return nil, err
+		}
+		build = func(d direction) node { return netNode{d, ipnet} }
+	case "port":
+		arg, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		port, err := strconv.ParseUint(arg, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q in filter", arg)
+		}
+		if protos == nil {
+			protos = []uint32{protoTCP, protoUDP, protoSCTP}
+		}
+		build = func(d direction) node { return portNode{d, uint32(port), protos} }
+	default:
+		return nil, fmt.Errorf("unknown filter keyword %q", tok)
+	}
+
+	var n node = orNode{build(dirSrc), build(dirDst)}
+	if len(dirs) == 1 {
+		n = build(dirs[0])
+	}
+	if qualifier != nil {
+		n = andNode{qualifier, n}
+	}
+	return n, nil
+}
+
+func parseNet(arg string, host bool) (*net.IPNet, error) {
+	if ip := net.ParseIP(arg); ip != nil {
+		bits := 128
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	if !host {
+		if _, ipnet, err := net.ParseCIDR(arg); err == nil {
+			return ipnet, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid address %q in filter", arg)
+}
+
+type label int
+
+// instruction is a BPF instruction whose jumps name labels, resolved into
+// offsets once the program is complete.
+type instruction struct {
+	op          bpf.Instruction
+	conditional bool
+	always      bool
+	cond        bpf.JumpTest
+	val         uint32
+	jt, jf      label
+}
+
+type compiler struct {
+	prog   []instruction
+	labels map[label]int
+	count  label
+}
+
+func (c *compiler) newLabel() label {
+	c.count++
+	return c.count
+}
+
+func (c *compiler) place(l label) {
+	c.labels[l] = len(c.prog)
+}
+
+func (c *compiler) emit(op bpf.Instruction) {
+	c.prog = append(c.prog, instruction{op: op})
+}
+
+func (c *compiler) jump(cond bpf.JumpTest, val uint32, t, f label) {
+	c.prog = append(c.prog, instruction{conditional: true, cond: cond, val: val, jt: t, jf: f})
+}
+
+func (c *compiler) goTo(l label) {
+	c.prog = append(c.prog, instruction{always: true, jt: l})
+}
+
+// jumpAny jumps to t if A equals one of vals.
+func (c *compiler) jumpAny(vals []uint32, t, f label) {
+	for i, v := range vals {
+		if i == len(vals)-1 {
+			c.jump(bpf.JumpEqual, v, t, f)
+			break
+		}
+		next := c.newLabel()
+		c.jump(bpf.JumpEqual, v, t, next)
+		c.place(next)
+	}
+}
+
+func (c *compiler) loadEthertype() {
+	c.emit(bpf.LoadExtension{Num: bpf.ExtProto})
+}
+
+// gen emits code that continues at t when n matches and at f otherwise.
+func (c *compiler) gen(n node, t, f label) {
+	switch n := n.(type) {
+	case andNode:
+		mid := c.newLabel()
+		c.gen(n.a, mid, f)
+		c.place(mid)
+		c.gen(n.b, t, f)
+	case orNode:
+		mid := c.newLabel()
+		c.gen(n.a, t, mid)
+		c.place(mid)
+		c.gen(n.b, t, f)
+	case notNode:
+		c.gen(n.a, f, t)
+	case etherNode:
+		c.loadEthertype()
+		c.jump(bpf.JumpEqual, n.ethertype, t, f)
+	case protoNode:
+		c.genProto(n, t, f)
+	case netNode:
+		c.genNet(n, t, f)
+	case portNode:
+		c.genPort(n, t, f)
+	}
+}
+
+func (c *compiler) genProto(n protoNode, t, f label) {
+	c.loadEthertype()
+	notV4 := f
+	if n.ipv4 && n.ipv6 {
+		notV4 = c.newLabel()
+	}
+	if n.ipv4 {
+		v4 := c.newLabel()
+		c.jump(bpf.JumpEqual, etherIPv4, v4, notV4)
+		c.place(v4)
+		c.emit(bpf.LoadAbsolute{Off: 9, Size: 1})
+		c.jump(bpf.JumpEqual, n.proto, t, f)
+	}
+	if n.ipv6 {
+		if n.ipv4 {
+			c.place(notV4)
+		}
+		v6 := c.newLabel()
+		c.jump(bpf.JumpEqual, etherIPv6, v6, f)
+		c.place(v6)
+		c.emit(bpf.LoadAbsolute{Off: 6, Size: 1})
+		c.jump(bpf.JumpEqual, n.proto, t, f)
+	}
+}
+
+func (c *compiler) genNet(n netNode, t, f label) {
+	ok := c.newLabel()
+	c.loadEthertype()
+	if ip4 := n.net.IP.To4(); ip4 != nil && len(n.net.Mask) == net.IPv4len {
+		c.jump(bpf.JumpEqual, etherIPv4, ok, f)
+		c.place(ok)
+		off := uint32(12)
+		if n.dir == dirDst {
+			off = 16
+		}
+		c.genMaskedWords(off, ip4, n.net.Mask, t, f)
+		return
+	}
+	c.jump(bpf.JumpEqual, etherIPv6, ok, f)
+	c.place(ok)
+	off := uint32(8)
+	if n.dir == dirDst {
+		off = 24
+	}
+	c.genMaskedWords(off, n.net.IP.To16(), n.net.Mask, t, f)
+}
+
+// genMaskedWords compares the address at off, one 32-bit word at a time,
+// with the masked network address.
+func (c *compiler) genMaskedWords(off uint32, ip net.IP, mask net.IPMask, t, f label) {
+	var words []int
+	for i := 0; i < len(mask)/4; i++ {
+		if binary.BigEndian.Uint32(mask[i*4:]) != 0 {
+			words = append(words, i)
+		}
+	}
+	if len(words) == 0 {
+		c.goTo(t)
+		return
+	}
+	for j, i := range words {
+		m := binary.BigEndian.Uint32(mask[i*4:])
+		c.emit(bpf.LoadAbsolute{Off: off + uint32(i*4), Size: 4})
+		if m != 0xffffffff {
+			c.emit(bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: m})
+		}
+		next := t
+		if j < len(words)-1 {
+			next = c.newLabel()
+		}
+		c.jump(bpf.JumpEqual, binary.BigEndian.Uint32(ip[i*4:])&m, next, f)
+		if next != t {
+			c.place(next)
+		}
+	}
+}
+
+// genPort matches the port of unfragmented IPv4 packets and of IPv6 packets
+// without extension headers, like tcpdump.
+func (c *compiler) genPort(n portNode, t, f label) {
+	v4, v6, notV4, proto4, proto6, first := c.newLabel(), c.newLabel(), c.newLabel(), c.newLabel(), c.newLabel(), c.newLabel()
+	off := uint32(0)
+	if n.dir == dirDst {
+		off = 2
+	}
+
+	c.loadEthertype()
+	c.jump(bpf.JumpEqual, etherIPv4, v4, notV4)
+	c.place(v4)
+	c.emit(bpf.LoadAbsolute{Off: 9, Size: 1})
+	c.jumpAny(n.protos, proto4, f)
+	c.place(proto4)
+	c.emit(bpf.LoadAbsolute{Off: 6, Size: 2})
+	c.jump(bpf.JumpBitsSet, 0x1fff, f, first)
+	c.place(first)
+	c.emit(bpf.LoadMemShift{Off: 0})
+	c.emit(bpf.LoadIndirect{Off: off, Size: 2})
+	c.jump(bpf.JumpEqual, n.port, t, f)
+
+	c.place(notV4)
+	c.jump(bpf.JumpEqual, etherIPv6, v6, f)
+	c.place(v6)
+	c.emit(bpf.LoadAbsolute{Off: 6, Size: 1})
+	c.jumpAny(n.protos, proto6, f)
+	c.place(proto6)
+	c.emit(bpf.LoadAbsolute{Off: 40 + off, Size: 2})
+	c.jump(bpf.JumpEqual, n.port, t, f)
+}
+
+// assemble resolves the labels. Conditional jumps only reach 255
+// instructions ahead, which bounds the size of a filter.
+func (c *compiler) assemble() ([]bpf.RawInstruction, error) {
+	prog := make([]bpf.Instruction, len(c.prog))
+	for i, insn := range c.prog {
+		if insn.always {
+			prog[i] = bpf.Jump{Skip: uint32(c.labels[insn.jt] - i - 1)}
+			continue
+		}
+		if !insn.conditional {
+			prog[i] = insn.op
+			continue
+		}
+		jt, jf := c.labels[insn.jt]-i-1, c.labels[insn.jf]-i-1
+		if jt < 0 || jf < 0 || jt > 255 || jf > 255 {
+			return nil, errors.New("filter is too long")
+		}
+		prog[i] = bpf.JumpIf{Cond: insn.cond, Val: insn.val, SkipTrue: uint8(jt), SkipFalse: uint8(jf)}
+	}
+	return bpf.Assemble(prog)
+}
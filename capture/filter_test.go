@@ -0,0 +1,172 @@
+package capture
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"golang.org/x/net/bpf"
+)
+
+// ipv4Packet builds an IPv4 header without options followed by the source
+// and destination ports of a transport header.
+func ipv4Packet(proto byte, src, dst string, sport, dport uint16, fragOff uint16) []byte {
+	p := make([]byte, 20+8)
+	p[0] = 0x45
+	binary.BigEndian.PutUint16(p[2:], uint16(len(p)))
+	binary.BigEndian.PutUint16(p[6:], fragOff)
+	p[8] = 64
+	p[9] = proto
+	copy(p[12:], net.ParseIP(src).To4())
+	copy(p[16:], net.ParseIP(dst).To4())
+	binary.BigEndian.PutUint16(p[20:], sport)
+	binary.BigEndian.PutUint16(p[22:], dport)
+	return p
+}
+
+func ipv6Packet(next byte, src, dst string, sport, dport uint16) []byte {
+	p := make([]byte, 40+8)
+	p[0] = 0x60
+	binary.BigEndian.PutUint16(p[4:], 8)
+	p[6] = next
+	p[7] = 64
+	copy(p[8:], net.ParseIP(src).To16())
+	copy(p[24:], net.ParseIP(dst).To16())
+	binary.BigEndian.PutUint16(p[40:], sport)
+	binary.BigEndian.PutUint16(p[42:], dport)
+	return p
+}
+
+// run executes a compiled filter on a packet. The VM does not implement the
+// protocol extension, so the ethertype is put in front of the packet, loads
+// of it are redirected there and all other loads are shifted past it.
+func run(t *testing.T, raw []bpf.RawInstruction, ethertype uint16, packet []byte) bool {
+	t.Helper()
+	if raw == nil {
+		return true
+	}
+	prog, ok := bpf.Disassemble(raw)
+	if !ok {
+		t.Fatalf("cannot disassemble %v", raw)
+	}
+	for i, ins := range prog {
+		switch ins := ins.(type) {
+		case bpf.LoadExtension:
+			if ins.Num != bpf.ExtProto {
+				t.Fatalf("unexpected extension %v", ins.Num)
+			}
+			prog[i] = bpf.LoadAbsolute{Off: 0, Size: 2}
+		case bpf.LoadAbsolute:
+			ins.Off += 2
+			prog[i] = ins
+		case bpf.LoadIndirect:
+			ins.Off += 2
+			prog[i] = ins
+		case bpf.LoadMemShift:
+			ins.Off += 2
+			prog[i] = ins
+		}
+	}
+	vm, err := bpf.NewVM(prog)
+	if err != nil {
+		t.Fatalf("invalid program: %v", err)
+	}
+	in := binary.BigEndian.AppendUint16(nil, ethertype)
+	n, err := vm.Run(append(in, packet...))
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	return n > 0
+}
+
+func TestCompile(t *testing.T) {
+	tcp4 := ipv4Packet(protoTCP, "10.0.0.1", "192.0.2.7", 40000, 443, 0)
+	udp4 := ipv4Packet(protoUDP, "10.0.0.1", "192.0.2.7", 40000, 53, 0)
+	icmp4 := ipv4Packet(protoICMP, "10.0.0.1", "192.0.2.7", 0, 0, 0)
+	// A non-first fragment carries no transport header; its "ports" are
+	// payload bytes.
+	frag4 := ipv4Packet(protoTCP, "10.0.0.1", "192.0.2.7", 40000, 443, 185)
+	tcp6 := ipv6Packet(protoTCP, "2001:db8::1", "2001:db8:1::2", 40000, 443)
+	udp6 := ipv6Packet(protoUDP, "2001:db8::1", "2001:db8:1::2", 40000, 53)
+	icmp6 := ipv6Packet(protoICMPv6, "2001:db8::1", "2001:db8:1::2", 0, 0)
+	arp := make([]byte, 28)
+
+	type packet struct {
+		name      string
+		ethertype uint16
+		data      []byte
+	}
+	packets := []packet{
+		{"tcp4", etherIPv4, tcp4},
+		{"udp4", etherIPv4, udp4},
+		{"icmp4", etherIPv4, icmp4},
+		{"frag4", etherIPv4, frag4},
+		{"tcp6", etherIPv6, tcp6},
+		{"udp6", etherIPv6, udp6},
+		{"icmp6", etherIPv6, icmp6},
+		{"arp", etherARP, arp},
+	}
+
+	tests := []struct {
+		filter string
+		match  []string
+	}{
+		{"", []string{"tcp4", "udp4", "icmp4", "frag4", "tcp6", "udp6", "icmp6", "arp"}},
+		{"ip", []string{"tcp4", "udp4", "icmp4", "frag4"}},
+		{"ip6", []string{"tcp6", "udp6", "icmp6"}},
+		{"arp", []string{"arp"}},
+		{"tcp", []string{"tcp4", "frag4", "tcp6"}},
+		{"udp or icmp", []string{"udp4", "icmp4", "udp6"}},
+		{"icmp6", []string{"icmp6"}},
+		{"port 443", []string{"tcp4", "tcp6"}},
+		{"tcp dst port 443", []string{"tcp4", "tcp6"}},
+		{"udp port 443", nil},
+		{"src port 40000", []string{"tcp4", "udp4", "tcp6", "udp6"}},
+		{"dst port 40000", nil},
+		{"host 10.0.0.1", []string{"tcp4", "udp4", "icmp4", "frag4"}},
+		{"src host 192.0.2.7", nil},
+		{"dst net 192.0.2.0/24", []string{"tcp4", "udp4", "icmp4", "frag4"}},
+		{"net 10.0.0.0/8 and not port 53", []string{"tcp4", "icmp4", "frag4"}},
+		{"host 2001:db8::1", []string{"tcp6", "udp6", "icmp6"}},
+		{"dst net 2001:db8:1::/48", []string{"tcp6", "udp6", "icmp6"}},
+		{"net 2001:db8::/32 && !udp", []string{"tcp6", "icmp6"}},
+		{"tcp src host 10.0.0.1", []string{"tcp4", "frag4"}},
+		{"udp dst net 2001:db8:1::/48", []string{"udp6"}},
+		{"tcp host 2001:db8:1::2", []string{"tcp6"}},
+		{"(udp || icmp) and ip6", []string{"udp6"}},
+		{"not ip and not ip6", []string{"arp"}},
+	}
+	for _, tt := range tests {
+		raw, err := Compile(tt.filter)
+		if err != nil {
+			t.Errorf("Compile(%q): %v", tt.filter, err)
+			continue
+		}
+		want := make(map[string]bool)
+		for _, name := range tt.match {
+			want[name] = true
+		}
+		for _, p := range packets {
+			if got := run(t, raw, p.ethertype, p.data); got != want[p.name] {
+				t.Errorf("%q on %s: got %v, want %v", tt.filter, p.name, got, want[p.name])
+			}
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	for _, filter := range []string{
+		"port",
+		"port 70000",
+		"host 10.0.0.0/8",
+		"net nonsense",
+		"tcp and",
+		"(tcp",
+		"tcp)",
+		"ether host 00:11:22:33:44:55",
+	} {
+		if _, err := Compile(filter); err == nil {
+			t.Errorf("Compile(%q) succeeded", filter)
+		}
+	}
+}
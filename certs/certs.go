@@ -0,0 +1,240 @@
+// Package certs serves TLS certificates that can be replaced while the
+// server is running, and creates self-signed ones.
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	selfSignedValidity = 365 * 24 * time.Hour
+	// Self-signed certificates closer than this to expiry are replaced.
+	renewBefore = 30 * 24 * time.Hour
+	// How often Watch checks whether a self-signed certificate is due.
+	renewCheckInterval = 24 * time.Hour
+)
+
+// Reloader holds a certificate and key pair loaded from files and loads
+// them again when they change.
+type Reloader struct {
+	certFile, keyFile string
+	selfSigned        bool
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	leaf    *x509.Certificate
+	modTime time.Time
+}
+
+// NewReloader loads the certificate and key from their PEM files.
+func NewReloader(certFile, keyFile string) (*Reloader, error) {
+	r := &Reloader{certFile: certFile, keyFile: keyFile}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload loads the files again. On error the previous certificate stays in
+// use, and Watch does not retry until the files change again.
+func (r *Reloader) Reload() error {
+	modTime := r.lastModified()
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	var leaf *x509.Certificate
+	if err == nil {
+		leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.modTime = modTime
+	if err != nil {
+		return err
+	}
+	r.cert, r.leaf = &cert, leaf
+	return nil
+}
+
+// lastModified is the later modification time of the two files.
+func (r *Reloader) lastModified() time.Time {
+	var latest time.Time
+	for _, name := range []string{r.certFile, r.keyFile} {
+		if info, err := os.Stat(name); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
+
+// GetCertificate is meant for tls.Config.GetCertificate.
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// KeepSelfSigned makes Watch renew the files with EnsureSelfSigned once a
+// day, so a long running server does not end up with an expired certificate.
+func (r *Reloader) KeepSelfSigned() {
+	r.selfSigned = true
+}
+
+// Leaf is the certificate currently in use.
+func (r *Reloader) Leaf() *x509.Certificate {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.leaf
+}
+
+// Watch reloads the files on SIGHUP and when their modification time
+// changes, checked every interval. It calls reloaded with the outcome of
+// each reload, and with the error of a failed self-signed renewal, and never
+// returns.
+func (r *Reloader) Watch(interval time.Duration, reloaded func(error)) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	lastRenewCheck := time.Now()
+
+	for {
+		select {
+		case <-hup:
+		case <-ticker.C:
+			if r.selfSigned && time.Since(lastRenewCheck) >= renewCheckInterval {
+				lastRenewCheck = time.Now()
+				// New files are picked up by the modification time check.
+				if _, err := EnsureSelfSigned(r.certFile, r.keyFile); err != nil {
+					reloaded(err)
+				}
+			}
+			r.mu.RLock()
+			unchanged := r.lastModified().Equal(r.modTime)
+			r.mu.RUnlock()
+			if unchanged {
+				continue
+			}
+		}
+		reloaded(r.Reload())
+	}
+}
+
+// Fingerprint is the SHA-256 fingerprint of a certificate in the usual
+// colon separated form.
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
+
+// EnsureSelfSigned creates a self-signed certificate for this host and its
+// key unless the files already hold one that is not about to expire. It
+// reports whether new files were written.
+func EnsureSelfSigned(certFile, keyFile string) (bool, error) {
+	if cert, err := tls.LoadX509KeyPair(certFile, keyFile); err == nil {
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err == nil && time.Until(leaf.NotAfter) > renewBefore {
+			return false, nil
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return false, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return false, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return false, err
+	}
+	hostname, _ := os.Hostname()
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: hostname, Organization: []string{"Netron"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+	}
+	if hostname != "" && hostname != "localhost" {
+		template.DNSNames = append(template.DNSNames, hostname)
+	}
+	template.IPAddresses = hostAddresses()
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return false, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return false, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(certFile), 0700); err != nil {
+		return false, err
+	}
+	if err := os.MkdirAll(filepath.Dir(keyFile), 0700); err != nil {
+		return false, err
+	}
+	if err := writePEM(keyFile, "PRIVATE KEY", keyDER, 0600); err != nil {
+		return false, err
+	}
+	if err := writePEM(certFile, "CERTIFICATE", der, 0644); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// hostAddresses are the loopback and global addresses of the host, which
+// the certificate is valid for.
+func hostAddresses() []net.IP {
+	ips := []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return ips
+	}
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.IsLoopback() || ipnet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		ips = append(ips, ipnet.IP)
+	}
+	return ips
+}
+
+// writePEM replaces name through a temporary file, so a reloading server
+// never reads a partly written one.
+func writePEM(name, blockType string, der []byte, perm os.FileMode) error {
+	tmp := name + ".tmp"
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := os.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
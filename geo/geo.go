@@ -0,0 +1,92 @@
+// Package geo finds the public addresses of the host and locates IP
+// addresses, preferably from local MaxMind DB files so that no address is
+// disclosed to a third party.
+package geo
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Info is what is known about the location and network of an address.
+// Any field may be empty.
+type Info struct {
+	IP          string
+	ASN         uint
+	Org         string
+	City        string
+	Region      string
+	Country     string
+	CountryCode string
+}
+
+// Organization formats the network owner like "AS15169 Google LLC".
+func (i Info) Organization() string {
+	switch {
+	case i.ASN != 0 && i.Org != "":
+		return fmt.Sprintf("AS%d %s", i.ASN, i.Org)
+	case i.ASN != 0:
+		return fmt.Sprintf("AS%d", i.ASN)
+	}
+	return i.Org
+}
+
+// merge fills the empty fields of i from other.
+func (i *Info) merge(other Info) {
+	fill := func(dst *string, src string) {
+		if *dst == "" {
+			*dst = src
+		}
+	}
+	fill(&i.IP, other.IP)
+	fill(&i.Org, other.Org)
+	fill(&i.City, other.City)
+	fill(&i.Region, other.Region)
+	fill(&i.Country, other.Country)
+	fill(&i.CountryCode, other.CountryCode)
+	if i.ASN == 0 {
+		i.ASN = other.ASN
+	}
+}
+
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// IsPublic reports whether ip is a globally routable unicast address.
+func IsPublic(ip net.IP) bool {
+	return ip.IsGlobalUnicast() && !ip.IsPrivate() && !sharedAddressSpace.Contains(ip)
+}
+
+// LocalPublicIPs returns the public addresses assigned to the host's own
+// interfaces, IPv4 first. It is empty behind NAT.
+func LocalPublicIPs() []net.IP {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	var v4, v6 []net.IP
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || !IsPublic(ipnet.IP) {
+			continue
+		}
+		if ipnet.IP.To4() != nil {
+			v4 = append(v4, ipnet.IP)
+		} else {
+			v6 = append(v6, ipnet.IP)
+		}
+	}
+	return append(v4, v6...)
+}
+
+// parseOrg splits an organization formatted like "AS15169 Google LLC".
+func parseOrg(org string) (uint, string) {
+	var asn uint
+	if rest, ok := strings.CutPrefix(org, "AS"); ok {
+		if n, err := fmt.Sscanf(rest, "%d", &asn); err == nil && n == 1 {
+			_, name, _ := strings.Cut(rest, " ")
+			return asn, name
+		}
+	}
+	return 0, org
+}
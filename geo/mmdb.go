@@ -0,0 +1,79 @@
+package geo
+
+import (
+	"errors"
+	"net"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// DB looks addresses up in one or more MaxMind DB files, such as the
+// GeoLite2 or DB-IP City and ASN databases. The first file holding a field
+// wins.
+type DB struct {
+	readers []*maxminddb.Reader
+}
+
+type mmdbRecord struct {
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	Country struct {
+		ISOCode string            `maxminddb:"iso_code"`
+		Names   map[string]string `maxminddb:"names"`
+	} `maxminddb:"country"`
+	Subdivisions []struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"subdivisions"`
+	ASN   uint   `maxminddb:"autonomous_system_number"`
+	ASOrg string `maxminddb:"autonomous_system_organization"`
+}
+
+func OpenDB(paths []string) (*DB, error) {
+	if len(paths) == 0 {
+		return nil, errors.New("no database files given")
+	}
+	db := &DB{}
+	for _, path := range paths {
+		r, err := maxminddb.Open(path)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		db.readers = append(db.readers, r)
+	}
+	return db, nil
+}
+
+// Lookup returns what the databases know about ip. ok is false when no
+// database has a record for it.
+func (db *DB) Lookup(ip net.IP) (info Info, ok bool) {
+	for _, r := range db.readers {
+		var rec mmdbRecord
+		_, found, err := r.LookupNetwork(ip, &rec)
+		if err != nil || !found {
+			continue
+		}
+		ok = true
+
+		located := Info{
+			IP:          ip.String(),
+			ASN:         rec.ASN,
+			Org:         rec.ASOrg,
+			City:        rec.City.Names["en"],
+			Country:     rec.Country.Names["en"],
+			CountryCode: rec.Country.ISOCode,
+		}
+		if len(rec.Subdivisions) > 0 {
+			located.Region = rec.Subdivisions[0].Names["en"]
+		}
+		info.merge(located)
+	}
+	return info, ok
+}
+
+func (db *DB) Close() {
+	for _, r := range db.readers {
+		r.Close()
+	}
+}
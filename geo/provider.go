@@ -0,0 +1,200 @@
+package geo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Provider reports the public address requests from this host come from
+// over one address family, "tcp4" or "tcp6", and where it is located.
+// Unlike the local database it discloses that address to a third party.
+type Provider interface {
+	Name() string
+	Lookup(ctx context.Context, network string) (Info, error)
+}
+
+// JSONProvider queries an HTTP endpoint answering with a JSON object.
+// Fields maps the Info fields (ip, asn, org, city, region, country and
+// country_code) to dot separated paths into that object, where numeric
+// elements index arrays. URL6, when set, replaces URL for IPv6 lookups.
+type JSONProvider struct {
+	ProviderName string
+	URL          string
+	URL6         string
+	Fields       map[string]string
+}
+
+var infoFields = []string{"ip", "asn", "org", "city", "region", "country", "country_code"}
+
+var providers = map[string]*JSONProvider{
+	"ipinfo": {
+		ProviderName: "ipinfo",
+		URL:          "https://ipinfo.io/json",
+		URL6:         "https://v6.ipinfo.io/json",
+		Fields:       map[string]string{"ip": "ip", "org": "org", "city": "city", "region": "region", "country_code": "country"},
+	},
+	"ip-api": {
+		ProviderName: "ip-api",
+		URL:          "http://ip-api.com/json",
+		Fields:       map[string]string{"ip": "query", "org": "as", "city": "city", "region": "regionName", "country": "country", "country_code": "countryCode"},
+	},
+	"ifconfig.co": {
+		ProviderName: "ifconfig.co",
+		URL:          "https://ifconfig.co/json",
+		Fields:       map[string]string{"ip": "ip", "asn": "asn", "org": "asn_org", "city": "city", "region": "region_name", "country": "country", "country_code": "country_iso"},
+	},
+}
+
+// ProviderNames lists the built-in providers.
+func ProviderNames() []string {
+	names := make([]string, 0, len(providers))
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LookupProvider returns the built-in provider called name.
+func LookupProvider(name string) (Provider, error) {
+	p, ok := providers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown geo provider %q (available: %s, or a custom URL)", name, strings.Join(ProviderNames(), ", "))
+	}
+	return p, nil
+}
+
+// NewCustomProvider builds a provider for url from a field mapping written
+// as "ip=query,org=as,city=city". Without an ip mapping the answer is
+// expected to hold the address under "ip".
+func NewCustomProvider(url, mapping string) (*JSONProvider, error) {
+	fields := map[string]string{"ip": "ip"}
+	for _, pair := range strings.Split(mapping, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		field, path, ok := strings.Cut(pair, "=")
+		if !ok || path == "" {
+			return nil, fmt.Errorf("invalid field mapping %q, expected field=path", pair)
+		}
+		if !containsString(infoFields, field) {
+			return nil, fmt.Errorf("unknown field %q (available: %s)", field, strings.Join(infoFields, ", "))
+		}
+		fields[field] = path
+	}
+	return &JSONProvider{ProviderName: "custom", URL: url, Fields: fields}, nil
+}
+
+func (p *JSONProvider) Name() string {
+	return p.ProviderName
+}
+
+func (p *JSONProvider) Lookup(ctx context.Context, network string) (Info, error) {
+	url := p.URL
+	if network == "tcp6" && p.URL6 != "" {
+		url = p.URL6
+	}
+
+	// Dialing over one family makes the provider see our address in it.
+	dialer := &net.Dialer{}
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, addr)
+			},
+		},
+	}
+	defer client.CloseIdleConnections()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return Info{}, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return Info{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Info{}, fmt.Errorf("%s returned %s", p.ProviderName, resp.Status)
+	}
+
+	var body interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return Info{}, fmt.Errorf("%s returned invalid JSON: %v", p.ProviderName, err)
+	}
+
+	get := func(field string) string {
+		if path, ok := p.Fields[field]; ok {
+			return jsonPath(body, path)
+		}
+		return ""
+	}
+	info := Info{
+		City:        get("city"),
+		Region:      get("region"),
+		Country:     get("country"),
+		CountryCode: get("country_code"),
+	}
+	info.ASN, info.Org = parseOrg(get("org"))
+	if asn := get("asn"); asn != "" {
+		n, _ := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(asn), "AS"), 10, 32)
+		info.ASN = uint(n)
+	}
+
+	ip := net.ParseIP(get("ip"))
+	if ip == nil {
+		return Info{}, fmt.Errorf("%s did not return an IP address", p.ProviderName)
+	}
+	if (ip.To4() != nil) != (network == "tcp4") {
+		return Info{}, fmt.Errorf("%s returned %s over %s", p.ProviderName, ip, network)
+	}
+	info.IP = ip.String()
+	return info, nil
+}
+
+// jsonPath returns the value at a dot separated path in v as a string, or
+// an empty string if there is none.
+func jsonPath(v interface{}, path string) string {
+	for _, key := range strings.Split(path, ".") {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			v = node[key]
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return ""
+			}
+			v = node[i]
+		default:
+			return ""
+		}
+	}
+	switch value := v.(type) {
+	case string:
+		return value
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(value)
+	}
+	return ""
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -3,3 +3,22 @@ module netron
 go 1.21
 
 require github.com/gorilla/mux v1.8.0
+
+require golang.org/x/sys v0.30.0
+
+require (
+	github.com/oschwald/maxminddb-golang v1.13.1
+	golang.org/x/crypto v0.31.0
+	golang.org/x/net v0.33.0
+	golang.zx2c4.com/wireguard/wgctrl v0.0.0-20241231184526-a9ab2273dd10
+)
+
+require (
+	github.com/google/go-cmp v0.6.0 // indirect
+	github.com/josharian/native v1.1.0 // indirect
+	github.com/mdlayher/genetlink v1.3.2 // indirect
+	github.com/mdlayher/netlink v1.7.2 // indirect
+	github.com/mdlayher/socket v0.5.1 // indirect
+	golang.org/x/sync v0.10.0 // indirect
+	golang.zx2c4.com/wireguard v0.0.0-20231211153847-12269c276173 // indirect
+)
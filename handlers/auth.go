@@ -0,0 +1,478 @@
+package handlers
+
+import (
+    "bufio"
+    "context"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/hex"
+    "fmt"
+    "log"
+    "net"
+    "net/http"
+    "net/url"
+    "os"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "netron/models"
+
+    "golang.org/x/crypto/bcrypt"
+)
+
+const (
+    sessionCookie     = "netron_session"
+    loginPage         = "/login.html"
+    DefaultSessionTTL = 24 * time.Hour
+
+    // An address may fail this many logins freely. After that it has to
+    // wait a second before the next attempt, twice as long after each
+    // further failure, up to maxLoginBackoff. Failures are forgotten
+    // maxLoginBackoff after the last one.
+    freeLoginFailures = 5
+    maxLoginBackoff   = 15 * time.Minute
+)
+
+// Roles, from least to most privileged. Every authenticated user may view
+// the dashboard and API.
+const (
+    RoleViewer   = "viewer"
+    RoleOperator = "operator"
+    RoleAdmin    = "admin"
+)
+
+// Actions that need more than the viewer role.
+const (
+    ActionRunSpeedTest      = "speedtest.run"
+    ActionScheduleSpeedTest = "speedtest.schedule"
+    ActionCapture           = "capture"
+)
+
+var roleRanks = map[string]int{
+    RoleViewer:   0,
+    RoleOperator: 1,
+    RoleAdmin:    2,
+}
+
+// actionRoles is the least privileged role allowed to perform each action.
+var actionRoles = map[string]string{
+    ActionRunSpeedTest:      RoleOperator,
+    ActionScheduleSpeedTest: RoleAdmin,
+    ActionCapture:           RoleAdmin,
+}
+
+// AuthConfig enables authentication with the users and API tokens listed in
+// File. Without a file every request is allowed.
+type AuthConfig struct {
+    File       string
+    SessionTTL time.Duration
+}
+
+// identity is who a request was authenticated as.
+type identity struct {
+    name string
+    role string
+}
+
+type authAccount struct {
+    hash []byte
+    role string
+}
+
+type authSession struct {
+    identity
+    expires time.Time
+}
+
+type authContextKey struct{}
+
+type loginFailures struct {
+    count int
+    last  time.Time
+}
+
+var (
+    authEnabled bool
+    sessionTTL  time.Duration
+    // authUsers holds the bcrypt hash of each user's password and authTokens
+    // each API token by the hex SHA-256 of the token.
+    authUsers  map[string]authAccount
+    authTokens map[string]identity
+
+    authMutex sync.Mutex
+    sessions  = make(map[string]authSession)
+    // verifiedPasswords remembers the credentials that passed bcrypt, so
+    // basic auth clients polling the API are not slowed down by a bcrypt
+    // comparison on every request. Entries are keyed by an HMAC of user and
+    // password under verifiedKey, a random key that never leaves the
+    // process, so a wrong guess still costs a bcrypt comparison.
+    verifiedPasswords = make(map[string]bool)
+    verifiedKey       []byte
+    // dummyHash is compared against for unknown users, so that their
+    // failures take as long as those of known users.
+    dummyHash []byte
+    // failedLogins counts recent failures by client address. Addresses
+    // rather than users are throttled, so nobody can lock a user out by
+    // failing logins on their behalf.
+    failedLogins = make(map[string]*loginFailures)
+)
+
+// publicPaths are served without authentication so the login page works.
+var publicPaths = map[string]bool{
+    loginPage:    true,
+    "/style.css": true,
+    "/api/login": true,
+}
+
+// StartAuth loads the auth file. Each line is either
+//
+//	user <name> <bcrypt hash> [role]
+//	token <name> <hex SHA-256 of the token> [role]
+//
+// where role is viewer, operator or admin, the default. Empty lines and
+// lines starting with # are ignored.
+func StartAuth(cfg AuthConfig) error {
+    if cfg.File == "" {
+        return nil
+    }
+    if cfg.SessionTTL <= 0 {
+        return fmt.Errorf("the session lifetime must be positive")
+    }
+    file, err := os.Open(cfg.File)
+    if err != nil {
+        return err
+    }
+    defer file.Close()
+
+    users := make(map[string]authAccount)
+    tokens := make(map[string]identity)
+    scanner := bufio.NewScanner(file)
+    for n := 1; scanner.Scan(); n++ {
+        fields := strings.Fields(scanner.Text())
+        if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+            continue
+        }
+        if len(fields) < 3 || len(fields) > 4 {
+            return fmt.Errorf("%s:%d: expected user or token, a name, a hash and an optional role", cfg.File, n)
+        }
+        role := RoleAdmin
+        if len(fields) == 4 {
+            role = fields[3]
+            if _, ok := roleRanks[role]; !ok {
+                return fmt.Errorf("%s:%d: unknown role %q", cfg.File, n, role)
+            }
+        }
+        switch fields[0] {
+        case "user":
+            if _, err := bcrypt.Cost([]byte(fields[2])); err != nil {
+                return fmt.Errorf("%s:%d: %s is not a bcrypt hash", cfg.File, n, fields[1])
+            }
+            users[fields[1]] = authAccount{hash: []byte(fields[2]), role: role}
+        case "token":
+            hash := strings.ToLower(fields[2])
+            if b, err := hex.DecodeString(hash); err != nil || len(b) != sha256.Size {
+                return fmt.Errorf("%s:%d: the hash of token %s is not a hex SHA-256", cfg.File, n, fields[1])
+            }
+            tokens[hash] = identity{name: fields[1], role: role}
+        default:
+            return fmt.Errorf("%s:%d: unknown entry %q", cfg.File, n, fields[0])
+        }
+    }
+    if err := scanner.Err(); err != nil {
+        return err
+    }
+    if len(users) == 0 && len(tokens) == 0 {
+        return fmt.Errorf("%s lists no users or tokens", cfg.File)
+    }
+
+    verifiedKey = make([]byte, 32)
+    if _, err := rand.Read(verifiedKey); err != nil {
+        return err
+    }
+    dummyHash, err = bcrypt.GenerateFromPassword(verifiedKey, bcrypt.DefaultCost)
+    if err != nil {
+        return err
+    }
+
+    authUsers, authTokens = users, tokens
+    sessionTTL = cfg.SessionTTL
+    authEnabled = true
+    return nil
+}
+
+// HashPassword returns the bcrypt hash of a password for the auth file.
+func HashPassword(password string) (string, error) {
+    hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+    return string(hash), err
+}
+
+func remoteHost(r *http.Request) string {
+    host, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        return r.RemoteAddr
+    }
+    return host
+}
+
+// loginWait is how long the address of r has to wait before its next
+// login attempt is checked, zero if it may try now.
+func loginWait(r *http.Request) time.Duration {
+    authMutex.Lock()
+    defer authMutex.Unlock()
+    f := failedLogins[remoteHost(r)]
+    if f == nil || f.count < freeLoginFailures {
+        return 0
+    }
+    backoff := maxLoginBackoff
+    if shift := f.count - freeLoginFailures; shift < 20 {
+        backoff = min(time.Second<<shift, maxLoginBackoff)
+    }
+    return max(time.Until(f.last.Add(backoff)), 0)
+}
+
+// recordLogin counts a failed login, or forgets earlier failures after a
+// successful one.
+func recordLogin(r *http.Request, ok bool) {
+    authMutex.Lock()
+    defer authMutex.Unlock()
+    now := time.Now()
+    for addr, f := range failedLogins {
+        if now.Sub(f.last) >= maxLoginBackoff {
+            delete(failedLogins, addr)
+        }
+    }
+    addr := remoteHost(r)
+    if ok {
+        delete(failedLogins, addr)
+        return
+    }
+    if f := failedLogins[addr]; f != nil {
+        f.count++
+        f.last = now
+    } else {
+        failedLogins[addr] = &loginFailures{count: 1, last: now}
+    }
+}
+
+// checkPassword verifies the credentials of a basic auth request or login
+// and records the outcome for throttling. Credentials that passed before
+// are accepted even while the address is throttled, so API clients keep
+// working when someone else fails logins from behind the same address.
+// Other attempts from a throttled address fail without being checked.
+func checkPassword(r *http.Request, user, password string) bool {
+    mac := hmac.New(sha256.New, verifiedKey)
+    mac.Write([]byte(user))
+    mac.Write([]byte{0})
+    mac.Write([]byte(password))
+    key := string(mac.Sum(nil))
+
+    authMutex.Lock()
+    verified := verifiedPasswords[key]
+    authMutex.Unlock()
+    if verified {
+        return true
+    }
+    if loginWait(r) > 0 {
+        return false
+    }
+
+    account, known := authUsers[user]
+    hash := account.hash
+    if !known {
+        hash = dummyHash
+    }
+    ok := bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil && known
+    recordLogin(r, ok)
+    if ok {
+        authMutex.Lock()
+        verifiedPasswords[key] = true
+        authMutex.Unlock()
+    }
+    return ok
+}
+
+// authenticate returns the user or token behind a request, from a bearer
+// token, basic auth credentials or a session cookie.
+func authenticate(r *http.Request) (identity, bool) {
+    if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+        sum := sha256.Sum256([]byte(token))
+        id, ok := authTokens[hex.EncodeToString(sum[:])]
+        return id, ok
+    }
+    if user, password, ok := r.BasicAuth(); ok {
+        if !checkPassword(r, user, password) {
+            return identity{}, false
+        }
+        return identity{name: user, role: authUsers[user].role}, true
+    }
+    if cookie, err := r.Cookie(sessionCookie); err == nil {
+        authMutex.Lock()
+        defer authMutex.Unlock()
+        session, ok := sessions[cookie.Value]
+        if ok && time.Now().Before(session.expires) {
+            return session.identity, true
+        }
+    }
+    return identity{}, false
+}
+
+// authUser is the user or token name a request was authenticated as, and
+// empty when authentication is off.
+func authUser(r *http.Request) string {
+    id, _ := r.Context().Value(authContextKey{}).(identity)
+    return id.name
+}
+
+// allowed reports whether the role of a request permits action. Without
+// authentication everything is allowed.
+func allowed(r *http.Request, action string) bool {
+    if !authEnabled {
+        return true
+    }
+    id, ok := r.Context().Value(authContextKey{}).(identity)
+    return ok && roleRanks[id.role] >= roleRanks[actionRoles[action]]
+}
+
+// RequirePermission wraps the handler of a route that performs action so
+// that only roles allowed to perform it get through.
+func RequirePermission(action string, handler http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if !allowed(r, action) {
+            writeError(w, http.StatusForbidden, "Your role does not permit "+action)
+            return
+        }
+        handler(w, r)
+    }
+}
+
+// RequireAuth is a mux middleware that lets only authenticated requests
+// through. API clients are answered with 401 and browsers are sent to the
+// login page.
+func RequireAuth(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if !authEnabled || publicPaths[r.URL.Path] {
+            next.ServeHTTP(w, r)
+            return
+        }
+        id, ok := authenticate(r)
+        // The capture token is enough on its own for the capture endpoint.
+        if !ok && r.URL.Path == "/api/capture" && captureToken != "" && captureAuthorized(r) {
+            id, ok = identity{name: "capture-token", role: RoleAdmin}, true
+        }
+        if ok {
+            next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), authContextKey{}, id)))
+            return
+        }
+        if _, _, basic := r.BasicAuth(); basic {
+            if wait := loginWait(r); wait > 0 {
+                w.Header().Set("Retry-After", strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+                writeError(w, http.StatusTooManyRequests, "Too many failed logins, try again later")
+                return
+            }
+        }
+        if r.Method == http.MethodGet && !strings.HasPrefix(r.URL.Path, "/api/") && !strings.HasPrefix(r.URL.Path, "/speedtest/") {
+            http.Redirect(w, r, loginPage+"?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+            return
+        }
+        // Not a Basic challenge, which would make browsers prompt for
+        // credentials whenever a dashboard session expires.
+        w.Header().Set("WWW-Authenticate", `Bearer realm="netron"`)
+        writeError(w, http.StatusUnauthorized, "Authentication required")
+    })
+}
+
+// safeRedirect keeps the page to return to after login on this host.
+func safeRedirect(next string) string {
+    if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+        return "/"
+    }
+    return next
+}
+
+// Login checks the username and password posted by the login form and
+// starts a session.
+func Login(w http.ResponseWriter, r *http.Request) {
+    next := safeRedirect(r.FormValue("next"))
+    if !authEnabled {
+        http.Redirect(w, r, next, http.StatusSeeOther)
+        return
+    }
+    user := r.PostFormValue("username")
+    if !checkPassword(r, user, r.PostFormValue("password")) {
+        log.Printf("Failed login for %q from %s", user, r.RemoteAddr)
+        reason := "1"
+        if loginWait(r) > 0 {
+            reason = "throttled"
+        }
+        http.Redirect(w, r, loginPage+"?error="+reason+"&next="+url.QueryEscape(next), http.StatusSeeOther)
+        return
+    }
+
+    b := make([]byte, 32)
+    if _, err := rand.Read(b); err != nil {
+        writeError(w, http.StatusInternalServerError, err.Error())
+        return
+    }
+    sessionID := hex.EncodeToString(b)
+    now := time.Now()
+    authMutex.Lock()
+    for k, s := range sessions {
+        if now.After(s.expires) {
+            delete(sessions, k)
+        }
+    }
+    sessions[sessionID] = authSession{
+        identity: identity{name: user, role: authUsers[user].role},
+        expires:  now.Add(sessionTTL),
+    }
+    authMutex.Unlock()
+
+    http.SetCookie(w, newSessionCookie(r, sessionID, int(sessionTTL/time.Second)))
+    http.Redirect(w, r, next, http.StatusSeeOther)
+}
+
+// newSessionCookie sets or, with a negative maxAge, clears the session
+// cookie. Both use the same attributes, as browsers may refuse to replace a
+// Secure cookie with one that is not.
+func newSessionCookie(r *http.Request, value string, maxAge int) *http.Cookie {
+    return &http.Cookie{
+        Name:     sessionCookie,
+        Value:    value,
+        Path:     "/",
+        MaxAge:   maxAge,
+        HttpOnly: true,
+        Secure:   r.TLS != nil,
+        SameSite: http.SameSiteLaxMode,
+    }
+}
+
+// Logout ends the session of the request.
+func Logout(w http.ResponseWriter, r *http.Request) {
+    if cookie, err := r.Cookie(sessionCookie); err == nil {
+        authMutex.Lock()
+        delete(sessions, cookie.Value)
+        authMutex.Unlock()
+    }
+    http.SetCookie(w, newSessionCookie(r, "", -1))
+    http.Redirect(w, r, loginPage, http.StatusSeeOther)
+}
+
+// GetCurrentUser tells the dashboard who is signed in and which actions
+// they may perform.
+func GetCurrentUser(w http.ResponseWriter, r *http.Request) {
+    me := models.CurrentUser{AuthEnabled: authEnabled, Role: RoleAdmin, Actions: []string{}}
+    if id, ok := r.Context().Value(authContextKey{}).(identity); ok {
+        me.User, me.Role = id.name, id.role
+    }
+    for action := range actionRoles {
+        if allowed(r, action) {
+            me.Actions = append(me.Actions, action)
+        }
+    }
+    sort.Strings(me.Actions)
+    writeJSON(w, http.StatusOK, me)
+}
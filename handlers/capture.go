@@ -0,0 +1,144 @@
+package handlers
+
+import (
+    "context"
+    "crypto/subtle"
+    "fmt"
+    "log"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "netron/capture"
+)
+
+const (
+    defaultCaptureDuration = 10 * time.Second
+    maxCaptureDuration     = 5 * time.Minute
+    defaultCaptureBytes    = 10 << 20
+    maxCaptureBytes        = 100 << 20
+    defaultCaptureSnaplen  = capture.MaxSnaplen
+)
+
+// CaptureConfig enables packet capture. Captures must present Token as a
+// bearer token; without one the endpoint is disabled.
+type CaptureConfig struct {
+    Token string
+}
+
+var (
+    captureToken string
+    captureMutex sync.Mutex
+)
+
+func ConfigureCapture(cfg CaptureConfig) error {
+    if cfg.Token != "" && len(cfg.Token) < 16 {
+        return fmt.Errorf("the capture token must be at least 16 characters")
+    }
+    captureToken = cfg.Token
+    return nil
+}
+
+func captureAuthorized(r *http.Request) bool {
+    token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+    return ok && subtle.ConstantTimeCompare([]byte(token), []byte(captureToken)) == 1
+}
+
+// GetCapture captures packets on ?interface= matching ?filter= and returns
+// them as a pcap file. It stops after ?duration= (default 10s, at most 5m),
+// ?count= packets or ?size= bytes (default 10 MB, at most 100 MB),
+// whichever comes first. ?snaplen= truncates packets, by default and at
+// most to capture.MaxSnaplen bytes. Only one capture runs at a time.
+func GetCapture(w http.ResponseWriter, r *http.Request) {
+    if captureToken == "" {
+        writeError(w, http.StatusNotFound, "Packet capture is disabled")
+        return
+    }
+    // With authentication on, RequireAuth and the capture permission have
+    // already let either the capture token or an admin through.
+    if !authEnabled && !captureAuthorized(r) {
+        w.Header().Set("WWW-Authenticate", `Bearer realm="netron capture"`)
+        writeError(w, http.StatusUnauthorized, "A valid capture token is required")
+        return
+    }
+
+    query := r.URL.Query()
+    iface := query.Get("interface")
+    if iface == "" {
+        writeError(w, http.StatusBadRequest, "Missing interface parameter")
+        return
+    }
+    duration := defaultCaptureDuration
+    if v := query.Get("duration"); v != "" {
+        d, err := time.ParseDuration(v)
+        if err != nil || d <= 0 || d > maxCaptureDuration {
+            writeError(w, http.StatusBadRequest, "duration must be between 0 and "+maxCaptureDuration.String())
+            return
+        }
+        duration = d
+    }
+    limits := capture.Limits{Bytes: defaultCaptureBytes}
+    if v := query.Get("size"); v != "" {
+        n, err := strconv.ParseInt(v, 10, 64)
+        if err != nil || n < 1 || n > maxCaptureBytes {
+            writeError(w, http.StatusBadRequest, fmt.Sprintf("size must be between 1 and %d bytes", maxCaptureBytes))
+            return
+        }
+        limits.Bytes = n
+    }
+    if v := query.Get("count"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n < 1 {
+            writeError(w, http.StatusBadRequest, "invalid count")
+            return
+        }
+        limits.Packets = n
+    }
+    snaplen := defaultCaptureSnaplen
+    if v := query.Get("snaplen"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n < 64 || n > defaultCaptureSnaplen {
+            writeError(w, http.StatusBadRequest, fmt.Sprintf("snaplen must be between 64 and %d", defaultCaptureSnaplen))
+            return
+        }
+        snaplen = n
+    }
+    filter, err := capture.Compile(query.Get("filter"))
+    if err != nil {
+        writeError(w, http.StatusBadRequest, err.Error())
+        return
+    }
+
+    if !captureMutex.TryLock() {
+        writeError(w, http.StatusConflict, "A capture is already running")
+        return
+    }
+    defer captureMutex.Unlock()
+
+    handle, err := capture.Open(iface, filter, snaplen)
+    if err != nil {
+        writeError(w, http.StatusBadRequest, err.Error())
+        return
+    }
+    defer handle.Close()
+
+    requester := r.RemoteAddr
+    if user := authUser(r); user != "" {
+        requester = user + " at " + requester
+    }
+    log.Printf("Packet capture on %s (filter %q, %s) requested by %s", iface, query.Get("filter"), duration, requester)
+    filename := fmt.Sprintf("netron-%s-%s.pcap", iface, time.Now().Format("20060102-150405"))
+    w.Header().Set("Content-Type", "application/vnd.tcpdump.pcap")
+    w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+
+    ctx, cancel := context.WithTimeout(r.Context(), duration)
+    defer cancel()
+    stats, err := handle.WriteTo(ctx, w, limits)
+    if err != nil {
+        log.Printf("Packet capture on %s failed: %v", iface, err)
+        return
+    }
+    log.Printf("Packet capture on %s finished: %d packets, %d bytes", iface, stats.Packets, stats.Bytes)
+}
@@ -0,0 +1,233 @@
+package handlers
+
+import (
+    "bufio"
+    "io/ioutil"
+    "net"
+    "net/http"
+    "os"
+    "strconv"
+    "strings"
+
+    "netron/models"
+)
+
+const (
+    conntrackPath      = "/proc/net/nf_conntrack"
+    conntrackCountPath = "/proc/sys/net/netfilter/nf_conntrack_count"
+    conntrackMaxPath   = "/proc/sys/net/netfilter/nf_conntrack_max"
+
+    defaultConntrackLimit = 100
+    maxConntrackLimit     = 1000
+)
+
+// conntrackFilter selects flows by protocol, state, NAT direction and an
+// address or port found in either tuple. Empty fields match everything.
+type conntrackFilter struct {
+    protocol string
+    state    string
+    nat      string
+    host     string
+    port     int
+}
+
+func (f conntrackFilter) match(flow models.ConntrackFlow) bool {
+    if f.protocol != "" && flow.Protocol != f.protocol {
+        return false
+    }
+    if f.state != "" && !strings.EqualFold(flow.State, f.state) {
+        return false
+    }
+    switch f.nat {
+    case "":
+    case "any":
+        if flow.NAT == "" {
+            return false
+        }
+    default:
+        if !strings.Contains(flow.NAT, f.nat) {
+            return false
+        }
+    }
+    tuples := []models.ConntrackTuple{flow.Original, flow.Reply}
+    if f.host != "" {
+        found := false
+        for _, t := range tuples {
+            found = found || t.Src == f.host || t.Dst == f.host
+        }
+        if !found {
+            return false
+        }
+    }
+    if f.port != 0 {
+        found := false
+        for _, t := range tuples {
+            found = found || t.SrcPort == f.port || t.DstPort == f.port
+        }
+        if !found {
+            return false
+        }
+    }
+    return true
+}
+
+// normalizeIP writes an address the way net.IP does. The kernel prints IPv6
+// tuples uncompressed, as in 2001:0db8:0000:0000:0000:0000:0000:0001.
+func normalizeIP(s string) string {
+    if ip := net.ParseIP(s); ip != nil {
+        return ip.String()
+    }
+    return s
+}
+
+// parseConntrackLine parses one line of /proc/net/nf_conntrack, such as
+//
+//  ipv4 2 tcp 6 431999 ESTABLISHED src=10.0.0.2 dst=1.1.1.1 sport=5000 dport=443 packets=4 bytes=300 src=1.1.1.1 dst=192.0.2.1 sport=443 dport=5000 packets=3 bytes=200 [ASSURED] mark=0 use=1
+//
+// The first key=value run is the original direction, the second the reply.
+// Protocols without a state, such as UDP, omit that field.
+func parseConntrackLine(line string) (models.ConntrackFlow, bool) {
+    fields := strings.Fields(line)
+    if len(fields) < 5 {
+        return models.ConntrackFlow{}, false
+    }
+    flow := models.ConntrackFlow{Family: fields[0], Protocol: fields[2]}
+    flow.Timeout, _ = strconv.Atoi(fields[4])
+
+    tuple := &flow.Original
+    for _, field := range fields[5:] {
+        key, value, ok := strings.Cut(field, "=")
+        if !ok {
+            switch field {
+            case "[ASSURED]":
+                flow.Assured = true
+            case "[UNREPLIED]":
+                flow.Unreplied = true
+            default:
+                if flow.State == "" && !strings.HasPrefix(field, "[") {
+                    flow.State = field
+                }
+            }
+            continue
+        }
+        // A second src starts the reply tuple.
+        if key == "src" && tuple.Src != "" {
+            tuple = &flow.Reply
+        }
+        switch key {
+        case "src":
+            tuple.Src = normalizeIP(value)
+        case "dst":
+            tuple.Dst = normalizeIP(value)
+        case "sport":
+            tuple.SrcPort, _ = strconv.Atoi(value)
+        case "dport":
+            tuple.DstPort, _ = strconv.Atoi(value)
+        case "packets":
+            tuple.Packets, _ = strconv.ParseUint(value, 10, 64)
+        case "bytes":
+            tuple.Bytes, _ = strconv.ParseUint(value, 10, 64)
+        case "mark":
+            flow.Mark, _ = strconv.ParseUint(value, 10, 32)
+        }
+    }
+    if flow.Original.Src == "" || flow.Reply.Src == "" {
+        return models.ConntrackFlow{}, false
+    }
+
+    // Without NAT the reply tuple mirrors the original one.
+    var nat []string
+    if flow.Reply.Dst != flow.Original.Src || flow.Reply.DstPort != flow.Original.SrcPort {
+        nat = append(nat, "snat")
+    }
+    if flow.Reply.Src != flow.Original.Dst || flow.Reply.SrcPort != flow.Original.DstPort {
+        nat = append(nat, "dnat")
+    }
+    flow.NAT = strings.Join(nat, ",")
+    return flow, true
+}
+
+func readConntrackSetting(path string) int {
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+        return 0
+    }
+    n, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+    return n
+}
+
+// GetConntrack summarizes the netfilter connection tracking table and lists
+// the flows matching ?protocol=, ?state=, ?nat=snat|dnat|any, ?host= and
+// ?port=, at most ?limit= of them.
+func GetConntrack(w http.ResponseWriter, r *http.Request) {
+    query := r.URL.Query()
+    filter := conntrackFilter{
+        protocol: strings.ToLower(query.Get("protocol")),
+        state:    query.Get("state"),
+        nat:      strings.ToLower(query.Get("nat")),
+        host:     query.Get("host"),
+    }
+    if filter.nat != "" && filter.nat != "snat" && filter.nat != "dnat" && filter.nat != "any" {
+        writeError(w, http.StatusBadRequest, "nat must be snat, dnat or any")
+        return
+    }
+    filter.host = normalizeIP(filter.host)
+    if v := query.Get("port"); v != "" {
+        port, err := strconv.Atoi(v)
+        if err != nil || port < 1 || port > 65535 {
+            writeError(w, http.StatusBadRequest, "invalid port")
+            return
+        }
+        filter.port = port
+    }
+    limit := defaultConntrackLimit
+    if v := query.Get("limit"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n < 1 {
+            writeError(w, http.StatusBadRequest, "invalid limit")
+            return
+        }
+        limit = min(n, maxConntrackLimit)
+    }
+
+    file, err := os.Open(conntrackPath)
+    if err != nil {
+        writeError(w, http.StatusServiceUnavailable, "Connection tracking is not available: "+err.Error())
+        return
+    }
+    defer file.Close()
+
+    table := models.ConntrackTable{
+        Max:       readConntrackSetting(conntrackMaxPath),
+        Protocols: make(map[string]int),
+        States:    make(map[string]int),
+        Flows:     []models.ConntrackFlow{},
+    }
+    scanner := bufio.NewScanner(file)
+    for scanner.Scan() {
+        flow, ok := parseConntrackLine(scanner.Text())
+        if !ok {
+            continue
+        }
+        table.Entries++
+        table.Protocols[flow.Protocol]++
+        if flow.State != "" {
+            table.States[flow.Protocol+"/"+flow.State]++
+        }
+        if flow.NAT != "" {
+            table.NAT++
+        }
+        if filter.match(flow) {
+            table.Matched++
+            if len(table.Flows) < limit {
+                table.Flows = append(table.Flows, flow)
+            }
+        }
+    }
+
+    table.Count = readConntrackSetting(conntrackCountPath)
+    if table.Max > 0 {
+        table.Usage = float64(table.Count) / float64(table.Max) * 100
+    }
+    writeJSON(w, http.StatusOK, table)
+}
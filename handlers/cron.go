@@ -0,0 +1,143 @@
+package handlers
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// cronSpec is a parsed five field cron expression
+// (minute hour day-of-month month day-of-week).
+type cronSpec struct {
+    minute, hour, dom, month, dow uint64
+    domStar, dowStar              bool
+}
+
+var cronMacros = map[string]string{
+    "@hourly":   "0 * * * *",
+    "@daily":    "0 0 * * *",
+    "@midnight": "0 0 * * *",
+    "@weekly":   "0 0 * * 0",
+    "@monthly":  "0 0 1 * *",
+}
+
+func parseCron(expr string) (*cronSpec, error) {
+    expr = strings.TrimSpace(expr)
+    if macro, ok := cronMacros[expr]; ok {
+        expr = macro
+    }
+
+    fields := strings.Fields(expr)
+    if len(fields) != 5 {
+        return nil, fmt.Errorf("cron expression must have 5 fields, got %d", len(fields))
+    }
+
+    // As in Vixie cron, a day field starting with * such as */2 counts as
+    // unrestricted for the day-of-month or day-of-week rule.
+    spec := &cronSpec{
+        domStar: strings.HasPrefix(fields[2], "*"),
+        dowStar: strings.HasPrefix(fields[4], "*"),
+    }
+    var err error
+    if spec.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+        return nil, fmt.Errorf("minute: %w", err)
+    }
+    if spec.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+        return nil, fmt.Errorf("hour: %w", err)
+    }
+    if spec.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+        return nil, fmt.Errorf("day of month: %w", err)
+    }
+    if spec.month, err = parseCronField(fields[3], 1, 12); err != nil {
+        return nil, fmt.Errorf("month: %w", err)
+    }
+    if spec.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+        return nil, fmt.Errorf("day of week: %w", err)
+    }
+    // Both 0 and 7 mean Sunday.
+    if spec.dow&(1<<7) != 0 {
+        spec.dow |= 1
+    }
+    return spec, nil
+}
+
+// parseCronField turns a comma separated list of values, ranges and steps
+// (e.g. "*/15", "1-5", "0,30") into a bitmask.
+func parseCronField(field string, min, max int) (uint64, error) {
+    var mask uint64
+    for _, part := range strings.Split(field, ",") {
+        rng, stepStr, hasStep := strings.Cut(part, "/")
+        step := 1
+        if hasStep {
+            var err error
+            if step, err = strconv.Atoi(stepStr); err != nil || step < 1 {
+                return 0, fmt.Errorf("invalid step %q", stepStr)
+            }
+        }
+
+        lo, hi := min, max
+        if rng != "*" {
+            loStr, hiStr, isRange := strings.Cut(rng, "-")
+            var err error
+            if lo, err = strconv.Atoi(loStr); err != nil {
+                return 0, fmt.Errorf("invalid value %q", loStr)
+            }
+            hi = lo
+            if isRange {
+                if hi, err = strconv.Atoi(hiStr); err != nil {
+                    return 0, fmt.Errorf("invalid value %q", hiStr)
+                }
+            } else if hasStep {
+                hi = max
+            }
+        }
+        if lo < min || hi > max || lo > hi {
+            return 0, fmt.Errorf("%q out of range %d-%d", part, min, max)
+        }
+
+        for v := lo; v <= hi; v += step {
+            mask |= 1 << uint(v)
+        }
+    }
+    return mask, nil
+}
+
+func (c *cronSpec) dayMatches(t time.Time) bool {
+    domMatch := c.dom&(1<<uint(t.Day())) != 0
+    dowMatch := c.dow&(1<<uint(t.Weekday())) != 0
+    // Classic cron semantics: when both day fields are restricted a day
+    // matching either of them is enough.
+    if !c.domStar && !c.dowStar {
+        return domMatch || dowMatch
+    }
+    return domMatch && dowMatch
+}
+
+// next returns the first time strictly after t that matches the spec, or
+// the zero time if none exists within five years.
+func (c *cronSpec) next(t time.Time) time.Time {
+    t = t.Truncate(time.Minute).Add(time.Minute)
+    limit := t.AddDate(5, 0, 0)
+
+    for t.Before(limit) {
+        if c.month&(1<<uint(t.Month())) == 0 {
+            t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+            continue
+        }
+        if !c.dayMatches(t) {
+            t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+            continue
+        }
+        if c.hour&(1<<uint(t.Hour())) == 0 {
+            t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+            continue
+        }
+        if c.minute&(1<<uint(t.Minute())) == 0 {
+            t = t.Add(time.Minute)
+            continue
+        }
+        return t
+    }
+    return time.Time{}
+}
@@ -0,0 +1,159 @@
+package handlers
+
+import (
+    "context"
+    "errors"
+    "net"
+    "strings"
+    "sync"
+    "time"
+
+    "netron/geo"
+    "netron/models"
+)
+
+const (
+    enrichTTL           = time.Hour
+    enrichLookupTimeout = 2 * time.Second
+    enrichQueueSize     = 256
+    maxEnrichEntries    = 10000
+)
+
+// EnrichConfig enables the enrichment of remote connection addresses with
+// reverse DNS and, when a local database is configured, country and ASN.
+// At most Rate addresses are looked up per second.
+type EnrichConfig struct {
+    Enabled bool
+    Rate    int
+}
+
+type enrichEntry struct {
+    info     models.AddressInfo
+    expires  time.Time
+    resolved bool
+    pending  bool
+}
+
+var (
+    enrichMutex   sync.Mutex
+    enrichCache   map[string]*enrichEntry
+    enrichQueue   chan string
+    enrichEnabled bool
+)
+
+// StartEnrichment starts the background lookups. Addresses are enriched
+// as they are first seen, so a connection may be listed without its
+// details for a moment.
+func StartEnrichment(cfg EnrichConfig) error {
+    if !cfg.Enabled {
+        return nil
+    }
+    if cfg.Rate < 1 {
+        return errors.New("the enrichment rate must be at least one lookup per second")
+    }
+
+    enrichCache = make(map[string]*enrichEntry)
+    enrichQueue = make(chan string, enrichQueueSize)
+    enrichEnabled = true
+
+    go func() {
+        limit := time.NewTicker(time.Second / time.Duration(cfg.Rate))
+        defer limit.Stop()
+        for ip := range enrichQueue {
+            <-limit.C
+            info := lookupAddress(ip)
+
+            enrichMutex.Lock()
+            enrichCache[ip] = &enrichEntry{info: info, expires: time.Now().Add(enrichTTL), resolved: true}
+            enrichMutex.Unlock()
+        }
+    }()
+    return nil
+}
+
+func lookupAddress(addr string) models.AddressInfo {
+    ip := net.ParseIP(addr)
+    info := models.AddressInfo{Public: geo.IsPublic(ip)}
+
+    ctx, cancel := context.WithTimeout(context.Background(), enrichLookupTimeout)
+    defer cancel()
+    if names, err := net.DefaultResolver.LookupAddr(ctx, addr); err == nil && len(names) > 0 {
+        info.Hostname = strings.TrimSuffix(names[0], ".")
+    }
+
+    if info.Public && geoDB != nil {
+        if located, ok := geoDB.Lookup(ip); ok {
+            info.Country = located.CountryCode
+            info.ASN = located.ASN
+            info.Org = located.Org
+        }
+    }
+    return info
+}
+
+// enrichAddress returns the cached details of the host in addr, a
+// host:port pair, queueing a lookup if they are missing or stale. Stale
+// details are served until they are refreshed.
+func enrichAddress(addr string) *models.AddressInfo {
+    host, _, err := net.SplitHostPort(addr)
+    if err != nil {
+        return nil
+    }
+    ip := net.ParseIP(host)
+    if ip == nil || ip.IsUnspecified() || ip.IsLoopback() {
+        return nil
+    }
+
+    enrichMutex.Lock()
+    defer enrichMutex.Unlock()
+
+    entry := enrichCache[host]
+    if entry == nil || (!entry.pending && time.Now().After(entry.expires)) {
+        if entry == nil && len(enrichCache) >= maxEnrichEntries {
+            pruneEnrichCache()
+        }
+        // When the queue is full the address is tried again next time.
+        select {
+        case enrichQueue <- host:
+            if entry == nil {
+                entry = &enrichEntry{}
+                enrichCache[host] = entry
+            }
+            entry.pending = true
+        default:
+        }
+    }
+    if entry == nil || !entry.resolved {
+        return nil
+    }
+    info := entry.info
+    return &info
+}
+
+// pruneEnrichCache drops expired entries and, if that is not enough, some
+// arbitrary ones. The caller must hold enrichMutex.
+func pruneEnrichCache() {
+    now := time.Now()
+    for host, entry := range enrichCache {
+        if !entry.pending && now.After(entry.expires) {
+            delete(enrichCache, host)
+        }
+    }
+    for host, entry := range enrichCache {
+        if len(enrichCache) < maxEnrichEntries*9/10 {
+            break
+        }
+        if !entry.pending {
+            delete(enrichCache, host)
+        }
+    }
+}
+
+func enrichConnections(connections []models.Connection) {
+    if !enrichEnabled {
+        return
+    }
+    for i := range connections {
+        connections[i].Remote = enrichAddress(connections[i].RemoteAddr)
+    }
+}
@@ -0,0 +1,186 @@
+package handlers
+
+import (
+    "context"
+    "errors"
+    "log"
+    "net"
+    "strings"
+    "sync"
+    "time"
+
+    "netron/geo"
+)
+
+const geoProviderTimeout = 10 * time.Second
+
+// GeoConfig selects where the public addresses and location of the host
+// come from. Databases are MaxMind DB files looked up with the public
+// addresses of the host's interfaces. Provider, a built-in provider name or
+// a URL mapped with ProviderFields, is only asked what the interfaces and
+// databases cannot tell, for example behind NAT. Results are kept for TTL.
+type GeoConfig struct {
+    Databases      []string
+    Provider       string
+    ProviderFields string
+    TTL            time.Duration
+}
+
+type hostLocation struct {
+    ipv4 string
+    ipv6 string
+    info *geo.Info
+}
+
+var (
+    geoMutex sync.Mutex
+    geoDB    *geo.DB
+    hostGeo  hostLocation
+)
+
+// StartGeo opens the configured databases and locates the host every
+// cfg.TTL until the process exits.
+func StartGeo(cfg GeoConfig) error {
+    var provider geo.Provider
+    if strings.HasPrefix(cfg.Provider, "http://") || strings.HasPrefix(cfg.Provider, "https://") {
+        custom, err := geo.NewCustomProvider(cfg.Provider, cfg.ProviderFields)
+        if err != nil {
+            return err
+        }
+        provider = custom
+    } else if cfg.Provider != "" {
+        builtin, err := geo.LookupProvider(cfg.Provider)
+        if err != nil {
+            return err
+        }
+        provider = builtin
+    }
+    if cfg.TTL < time.Minute {
+        return errors.New("the geo cache TTL must be at least 1m")
+    }
+
+    if len(cfg.Databases) > 0 {
+        db, err := geo.OpenDB(cfg.Databases)
+        if err != nil {
+            return err
+        }
+        geoDB = db
+    }
+
+    go func() {
+        for {
+            location := locateHost(provider)
+            geoMutex.Lock()
+            hostGeo = location
+            geoMutex.Unlock()
+            time.Sleep(cfg.TTL)
+        }
+    }()
+    return nil
+}
+
+// locateHost finds the public address of each family, from the interfaces
+// or else the provider, then looks them up in the local databases before
+// settling for what the provider says.
+func locateHost(provider geo.Provider) hostLocation {
+    type answer struct {
+        info geo.Info
+        ok   bool
+    }
+    asked := make(map[string]answer)
+    ask := func(network string) (geo.Info, bool) {
+        if provider == nil {
+            return geo.Info{}, false
+        }
+        if a, done := asked[network]; done {
+            return a.info, a.ok
+        }
+        ctx, cancel := context.WithTimeout(context.Background(), geoProviderTimeout)
+        defer cancel()
+        info, err := provider.Lookup(ctx, network)
+        if err != nil {
+            log.Printf("geo: %s lookup over %s failed: %v", provider.Name(), network, err)
+        }
+        asked[network] = answer{info, err == nil}
+        return info, err == nil
+    }
+
+    var location hostLocation
+    for _, ip := range geo.LocalPublicIPs() {
+        if ip.To4() != nil && location.ipv4 == "" {
+            location.ipv4 = ip.String()
+        } else if ip.To4() == nil && location.ipv6 == "" {
+            location.ipv6 = ip.String()
+        }
+    }
+    if location.ipv4 == "" {
+        if info, ok := ask("tcp4"); ok {
+            location.ipv4 = info.IP
+        }
+    }
+    if location.ipv6 == "" {
+        if info, ok := ask("tcp6"); ok {
+            location.ipv6 = info.IP
+        }
+    }
+
+    if geoDB != nil {
+        for _, ip := range []string{location.ipv4, location.ipv6} {
+            if ip == "" {
+                continue
+            }
+            if info, ok := geoDB.Lookup(net.ParseIP(ip)); ok {
+                location.info = &info
+                return location
+            }
+        }
+    }
+    for _, network := range []string{"tcp4", "tcp6"} {
+        if info, ok := ask(network); ok {
+            location.info = &info
+            break
+        }
+    }
+    return location
+}
+
+func getHostLocation() hostLocation {
+    geoMutex.Lock()
+    defer geoMutex.Unlock()
+    return hostGeo
+}
+
+func getOrganization(location hostLocation) string {
+    if info := location.info; info != nil && info.Organization() != "" {
+        return info.Organization()
+    }
+    return "Unknown"
+}
+
+func getLocation(location hostLocation) string {
+    info := location.info
+    if info == nil {
+        return "Unknown"
+    }
+    country := info.CountryCode
+    if country == "" {
+        country = info.Country
+    }
+    var parts []string
+    for _, s := range []string{info.City, country} {
+        if s != "" {
+            parts = append(parts, s)
+        }
+    }
+    if len(parts) == 0 {
+        return "Unknown"
+    }
+    return strings.Join(parts, " / ")
+}
+
+func getRegion(location hostLocation) string {
+    if info := location.info; info != nil && info.Region != "" {
+        return info.Region
+    }
+    return "Unknown"
+}
@@ -0,0 +1,242 @@
+package handlers
+
+import (
+    "errors"
+    "log"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+
+    "netron/history"
+    "netron/models"
+)
+
+var historyStore *history.Store
+
+// historyPruneInterval is how often metrics that stopped receiving samples
+// are looked for and removed from the store.
+const historyPruneInterval = time.Hour
+
+// ephemeralInterfacePrefixes name the host ends of container and pod
+// interfaces, which come and go with every container and would each leave
+// a metric behind for the whole retention.
+var ephemeralInterfacePrefixes = []string{"veth", "cali", "lxc"}
+
+// StartHistory records a snapshot of the host metrics into store at the
+// resolution of its finest tier until the process exits.
+func StartHistory(store *history.Store) {
+    historyStore = store
+    interval := store.Tiers()[0].Resolution
+
+    go func() {
+        sampler := &historySampler{failed: make(map[string]bool)}
+        ticker := time.NewTicker(interval)
+        defer ticker.Stop()
+
+        for now := range ticker.C {
+            sampler.sample(now)
+        }
+    }()
+}
+
+type historySampler struct {
+    lastTime   time.Time
+    lastIdle   uint64
+    lastTotal  uint64
+    lastIfaces map[string]models.InterfaceInfo
+    lastPrune  time.Time
+    // failed holds the metrics whose last record failed, so a persistent
+    // error is logged once rather than on every sample.
+    failed map[string]bool
+}
+
+// historyInterfaceName turns an interface name into the part of a metric
+// name, replacing characters the store does not accept.
+func historyInterfaceName(name string) string {
+    return strings.Map(func(c rune) rune {
+        if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("._-:@", c) {
+            return c
+        }
+        return '_'
+    }, name)
+}
+
+func ephemeralInterface(name string) bool {
+    for _, prefix := range ephemeralInterfacePrefixes {
+        if strings.HasPrefix(name, prefix) {
+            return true
+        }
+    }
+    return false
+}
+
+func (h *historySampler) sample(now time.Time) {
+    samples := make(map[string]float64)
+
+    if idle, total, ok := readCPUTimes(); ok {
+        if h.lastTotal > 0 && total > h.lastTotal {
+            busy := float64((total - h.lastTotal) - (idle - h.lastIdle))
+            samples["cpu.usage"] = busy / float64(total-h.lastTotal) * 100
+        }
+        h.lastIdle, h.lastTotal = idle, total
+    }
+
+    mem := getMemoryInfo()
+    if mem.Total > 0 {
+        samples["memory.used"] = float64(mem.Used)
+        samples["memory.percent"] = mem.Percent
+    }
+
+    if total, used, ok := getDiskUsage("/"); ok && total > 0 {
+        samples["disk.used"] = float64(used)
+        samples["disk.percent"] = float64(used) / float64(total) * 100
+    }
+
+    ifaces := make(map[string]models.InterfaceInfo)
+    for _, iface := range getInterfaces() {
+        if ephemeralInterface(iface.Name) {
+            continue
+        }
+        ifaces[iface.Name] = iface
+        prev, ok := h.lastIfaces[iface.Name]
+        if !ok || h.lastTime.IsZero() {
+            continue
+        }
+        elapsed := now.Sub(h.lastTime).Seconds()
+        if iface.BytesRecv >= prev.BytesRecv && iface.BytesSent >= prev.BytesSent && elapsed > 0 {
+            name := historyInterfaceName(iface.Name)
+            samples["net."+name+".rx_bps"] = float64(iface.BytesRecv-prev.BytesRecv) * 8 / elapsed
+            samples["net."+name+".tx_bps"] = float64(iface.BytesSent-prev.BytesSent) * 8 / elapsed
+        }
+    }
+    h.lastIfaces = ifaces
+    h.lastTime = now
+
+    samples["connections.tcp"] = float64(len(getTCPConnections()))
+    samples["connections.udp"] = float64(len(getUDPConnections()))
+
+    for metric, value := range samples {
+        err := historyStore.Record(metric, now, value)
+        if err != nil && !h.failed[metric] {
+            log.Printf("history: failed to record %s: %v", metric, err)
+        }
+        if err != nil {
+            h.failed[metric] = true
+        } else {
+            delete(h.failed, metric)
+        }
+    }
+
+    if now.Sub(h.lastPrune) >= historyPruneInterval {
+        h.lastPrune = now
+        pruned, err := historyStore.Prune(now)
+        if err != nil {
+            log.Printf("history: failed to prune: %v", err)
+        }
+        if len(pruned) > 0 {
+            log.Printf("history: removed %d metrics without recent samples: %s", len(pruned), strings.Join(pruned, ", "))
+        }
+    }
+}
+
+func GetHistoryMetrics(w http.ResponseWriter, r *http.Request) {
+    if historyStore == nil {
+        writeError(w, http.StatusServiceUnavailable, "History is disabled")
+        return
+    }
+
+    var tiers []models.HistoryTier
+    for _, tier := range historyStore.Tiers() {
+        tiers = append(tiers, models.HistoryTier{
+            Resolution: history.FormatSpan(tier.Resolution),
+            Retention:  history.FormatSpan(tier.Retention),
+        })
+    }
+
+    writeJSON(w, http.StatusOK, models.HistoryMetrics{
+        Tiers:   tiers,
+        Metrics: historyStore.Metrics(),
+    })
+}
+
+func GetHistory(w http.ResponseWriter, r *http.Request) {
+    if historyStore == nil {
+        writeError(w, http.StatusServiceUnavailable, "History is disabled")
+        return
+    }
+
+    query := r.URL.Query()
+    metric := query.Get("metric")
+    if metric == "" {
+        writeError(w, http.StatusBadRequest, "Missing metric parameter")
+        return
+    }
+
+    now := time.Now()
+    to, err := parseTimeParam(query.Get("to"), now, now)
+    if err != nil {
+        writeError(w, http.StatusBadRequest, "Invalid to: "+err.Error())
+        return
+    }
+    from, err := parseTimeParam(query.Get("from"), to.Add(-time.Hour), now)
+    if err != nil {
+        writeError(w, http.StatusBadRequest, "Invalid from: "+err.Error())
+        return
+    }
+    if !from.Before(to) {
+        writeError(w, http.StatusBadRequest, "from must be before to")
+        return
+    }
+
+    var step time.Duration
+    if s := query.Get("step"); s != "" {
+        if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+            step = time.Duration(secs) * time.Second
+        } else if step, err = history.ParseSpan(s); err != nil {
+            writeError(w, http.StatusBadRequest, "Invalid step: "+err.Error())
+            return
+        }
+        if step < time.Second {
+            writeError(w, http.StatusBadRequest, "step must be at least 1s")
+            return
+        }
+    }
+
+    points, step, err := historyStore.Query(metric, from, to, step)
+    if errors.Is(err, history.ErrUnknownMetric) {
+        writeError(w, http.StatusNotFound, "Unknown metric: "+metric)
+        return
+    }
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, err.Error())
+        return
+    }
+
+    writeJSON(w, http.StatusOK, models.HistorySeries{
+        Metric: metric,
+        From:   from.Unix(),
+        To:     to.Unix(),
+        Step:   int64(step / time.Second),
+        Points: points,
+    })
+}
+
+// parseTimeParam accepts a unix timestamp, an RFC 3339 time or a negative
+// duration relative to now such as "-6h" or "-7d".
+func parseTimeParam(value string, def, now time.Time) (time.Time, error) {
+    if value == "" {
+        return def, nil
+    }
+    if secs, err := strconv.ParseInt(value, 10, 64); err == nil {
+        return time.Unix(secs, 0), nil
+    }
+    if value[0] == '-' {
+        d, err := history.ParseSpan(value[1:])
+        if err != nil {
+            return time.Time{}, err
+        }
+        return now.Add(-d), nil
+    }
+    return time.Parse(time.RFC3339, value)
+}
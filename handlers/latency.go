@@ -0,0 +1,295 @@
+package handlers
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "log"
+    "math"
+    "net"
+    "net/http"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+
+    "netron/models"
+    "netron/probe"
+)
+
+const (
+    LatencyICMP = "icmp"
+    LatencyTCP  = "tcp"
+
+    DefaultLatencyTargets = "icmp:8.8.8.8,icmp:2001:4860:4860::8888"
+
+    latencyProbeSpacing = 200 * time.Millisecond
+    latencyProbeTimeout = 2 * time.Second
+    maxLatencyRounds    = 120
+)
+
+// LatencyConfig configures the latency monitor. Targets is a comma
+// separated list of [name=][method:]address entries, where method is icmp
+// (the default) or tcp and a tcp address is host:port. Every Interval each
+// target is sent Count probes.
+type LatencyConfig struct {
+    Targets  string
+    Interval time.Duration
+    Count    int
+}
+
+type latencyTarget struct {
+    name    string
+    method  string
+    address string
+
+    mu       sync.Mutex
+    resolved string
+    rounds   []models.LatencyRound
+}
+
+var latencyTargets []*latencyTarget
+
+func parseLatencyTargets(spec string) ([]*latencyTarget, error) {
+    var targets []*latencyTarget
+    seen := make(map[string]bool)
+    for _, entry := range strings.Split(spec, ",") {
+        entry = strings.TrimSpace(entry)
+        if entry == "" {
+            continue
+        }
+
+        name, target, named := strings.Cut(entry, "=")
+        if !named {
+            target = entry
+        }
+        method, address, ok := strings.Cut(target, ":")
+        if !ok || (method != LatencyICMP && method != LatencyTCP) {
+            method, address = LatencyICMP, target
+        }
+        if !named {
+            name = method + ":" + address
+        }
+
+        switch method {
+        case LatencyICMP:
+            address = strings.TrimSuffix(strings.TrimPrefix(address, "["), "]")
+            if address == "" {
+                return nil, fmt.Errorf("latency target %q has no address", entry)
+            }
+        case LatencyTCP:
+            if _, _, err := net.SplitHostPort(address); err != nil {
+                return nil, fmt.Errorf("latency target %q: tcp targets are host:port", entry)
+            }
+        }
+        if seen[name] {
+            return nil, fmt.Errorf("duplicate latency target %q", name)
+        }
+        seen[name] = true
+        targets = append(targets, &latencyTarget{name: name, method: method, address: address})
+    }
+    return targets, nil
+}
+
+// StartLatencyMonitor probes every configured target until the process
+// exits, keeping recent rounds in memory and recording their statistics
+// into the history store as latency.<target>.<stat>.
+func StartLatencyMonitor(cfg LatencyConfig) error {
+    targets, err := parseLatencyTargets(cfg.Targets)
+    if err != nil {
+        return err
+    }
+    if cfg.Count < 1 {
+        return errors.New("at least one probe per round is required")
+    }
+    if cfg.Interval < time.Duration(cfg.Count)*latencyProbeSpacing+latencyProbeTimeout {
+        return fmt.Errorf("the latency interval must be at least %s for %d probes",
+            time.Duration(cfg.Count)*latencyProbeSpacing+latencyProbeTimeout, cfg.Count)
+    }
+
+    latencyTargets = targets
+    for _, t := range targets {
+        go t.monitor(cfg)
+    }
+    return nil
+}
+
+func (t *latencyTarget) monitor(cfg LatencyConfig) {
+    ticker := time.NewTicker(cfg.Interval)
+    defer ticker.Stop()
+
+    for now := time.Now(); ; now = <-ticker.C {
+        round := t.probe(cfg.Count)
+        round.Timestamp = now.Format(time.RFC3339)
+
+        t.mu.Lock()
+        t.rounds = append(t.rounds, round)
+        if len(t.rounds) > maxLatencyRounds {
+            t.rounds = t.rounds[len(t.rounds)-maxLatencyRounds:]
+        }
+        t.mu.Unlock()
+
+        t.record(now, round)
+    }
+}
+
+// probe runs one round of count probes, sent latencyProbeSpacing apart.
+func (t *latencyTarget) probe(count int) models.LatencyRound {
+    round := models.LatencyRound{Sent: count, Loss: 100}
+
+    ctx, cancel := context.WithTimeout(context.Background(), time.Duration(count)*latencyProbeSpacing+latencyProbeTimeout)
+    defer cancel()
+
+    send, err := t.resolve(ctx)
+    if err != nil {
+        round.Error = err.Error()
+        return round
+    }
+
+    rtts := make([]time.Duration, count)
+    errs := make([]error, count)
+    var wg sync.WaitGroup
+    for i := 0; i < count; i++ {
+        if i > 0 {
+            time.Sleep(latencyProbeSpacing)
+        }
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            rtts[i], errs[i] = send(ctx)
+        }(i)
+    }
+    wg.Wait()
+
+    // Replies are kept in the order the probes were sent so that jitter
+    // compares consecutive probes.
+    var samples []float64
+    for i, err := range errs {
+        if err == nil {
+            samples = append(samples, float64(rtts[i])/float64(time.Millisecond))
+        } else if round.Error == "" {
+            round.Error = err.Error()
+        }
+    }
+    round.Received = len(samples)
+    round.Loss = float64(count-len(samples)) / float64(count) * 100
+    if len(samples) == 0 {
+        return round
+    }
+    if round.Loss == 0 {
+        round.Error = ""
+    }
+
+    sum := 0.0
+    round.Min, round.Max = math.Inf(1), math.Inf(-1)
+    for i, s := range samples {
+        sum += s
+        round.Min = math.Min(round.Min, s)
+        round.Max = math.Max(round.Max, s)
+        if i > 0 {
+            round.Jitter += math.Abs(s - samples[i-1])
+        }
+    }
+    round.Avg = sum / float64(len(samples))
+    if len(samples) > 1 {
+        round.Jitter /= float64(len(samples) - 1)
+    }
+    sorted := append([]float64{}, samples...)
+    sort.Float64s(sorted)
+    round.Median = sorted[len(sorted)/2]
+    return round
+}
+
+// resolve looks the target up again for every round, so that DNS changes
+// are followed, and returns a function sending one probe to it.
+func (t *latencyTarget) resolve(ctx context.Context) (func(context.Context) (time.Duration, error), error) {
+    host, port := t.address, ""
+    if t.method == LatencyTCP {
+        host, port, _ = net.SplitHostPort(t.address)
+    }
+
+    ip := net.ParseIP(host)
+    if ip == nil {
+        ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+        if err != nil {
+            return nil, err
+        }
+        ip = ips[0]
+    }
+
+    t.mu.Lock()
+    t.resolved = ip.String()
+    t.mu.Unlock()
+
+    if t.method == LatencyTCP {
+        address := net.JoinHostPort(ip.String(), port)
+        return func(ctx context.Context) (time.Duration, error) {
+            return probe.TCP(ctx, address, latencyProbeTimeout)
+        }, nil
+    }
+    return func(ctx context.Context) (time.Duration, error) {
+        return probe.ICMP(ctx, ip, latencyProbeTimeout)
+    }, nil
+}
+
+func (t *latencyTarget) record(now time.Time, round models.LatencyRound) {
+    if historyStore == nil {
+        return
+    }
+
+    prefix := "latency." + metricName(t.name) + "."
+    samples := map[string]float64{"loss": round.Loss}
+    if round.Received > 0 {
+        samples["min"] = round.Min
+        samples["avg"] = round.Avg
+        samples["max"] = round.Max
+        samples["jitter"] = round.Jitter
+    }
+    for stat, value := range samples {
+        if err := historyStore.Record(prefix+stat, now, value); err != nil {
+            log.Printf("history: failed to record %s: %v", prefix+stat, err)
+        }
+    }
+}
+
+// metricName replaces the characters history metric names cannot contain.
+func metricName(s string) string {
+    return strings.Map(func(c rune) rune {
+        if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("._-:@", c) {
+            return c
+        }
+        return '_'
+    }, s)
+}
+
+// GetLatency reports the recent rounds of every latency target, or of one
+// with ?target=name.
+func GetLatency(w http.ResponseWriter, r *http.Request) {
+    name := r.URL.Query().Get("target")
+
+    targets := make([]models.LatencyTarget, 0, len(latencyTargets))
+    for _, t := range latencyTargets {
+        if name != "" && t.name != name {
+            continue
+        }
+        t.mu.Lock()
+        target := models.LatencyTarget{
+            Name:     t.name,
+            Method:   t.method,
+            Address:  t.address,
+            Resolved: t.resolved,
+            Metric:   "latency." + metricName(t.name),
+            Rounds:   append([]models.LatencyRound{}, t.rounds...),
+        }
+        t.mu.Unlock()
+        if n := len(target.Rounds); n > 0 {
+            target.Last = &target.Rounds[n-1]
+        }
+        targets = append(targets, target)
+    }
+    if name != "" && len(targets) == 0 {
+        writeError(w, http.StatusNotFound, "Unknown latency target")
+        return
+    }
+    writeJSON(w, http.StatusOK, targets)
+}
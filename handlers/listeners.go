@@ -0,0 +1,279 @@
+package handlers
+
+import (
+    "bufio"
+    "io/ioutil"
+    "net"
+    "net/http"
+    "os"
+    "regexp"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "netron/models"
+)
+
+const (
+    listenerScanInterval = 10 * time.Second
+    // Changes are kept this long, so clients polling with ?since= do not
+    // miss any unless they stay away longer.
+    listenerChangeRetention = 24 * time.Hour
+    maxListenerChanges      = 10000
+)
+
+// listenerChange records a port that appeared or went away between two
+// scans.
+type listenerChange struct {
+    time     time.Time
+    key      string
+    added    bool
+    listener models.Listener
+}
+
+var (
+    listenersMutex       sync.Mutex
+    lastListeners        map[string]models.Listener
+    lastListenerScan     time.Time
+    previousListenerScan time.Time
+    // firstListenerScan is the oldest time changes can be reported since.
+    firstListenerScan time.Time
+    listenerChanges   []listenerChange
+
+    containerIDPattern = regexp.MustCompile(`[0-9a-f]{64}`)
+)
+
+// containerRuntimes maps cgroup path fragments to the runtime that creates
+// them, most specific first.
+var containerRuntimes = []struct{ fragment, runtime string }{
+    {"libpod", "podman"},
+    {"cri-containerd", "containerd"},
+    {"crio", "cri-o"},
+    {"docker", "docker"},
+    {"kubepods", "kubernetes"},
+    {"lxc", "lxc"},
+}
+
+type listenerSource struct {
+    path     string
+    protocol string
+    family   string
+    state    string
+}
+
+// Unconnected UDP sockets are in state 07 (CLOSE) with no remote port.
+var listenerSources = []listenerSource{
+    {"/proc/net/tcp", "tcp", "ipv4", "0A"},
+    {"/proc/net/tcp6", "tcp", "ipv6", "0A"},
+    {"/proc/net/udp", "udp", "ipv4", "07"},
+    {"/proc/net/udp6", "udp", "ipv6", "07"},
+}
+
+func listenerKey(l models.Listener) string {
+    return l.Protocol + " " + net.JoinHostPort(l.Address, strconv.Itoa(l.Port))
+}
+
+// scanListeners lists the listening TCP and bound UDP sockets with the
+// process, executable, systemd unit and container owning them. Sockets
+// shared through SO_REUSEPORT are listed once.
+func scanListeners() map[string]models.Listener {
+    listeners := make(map[string]models.Listener)
+    var owners map[uint64]socketOwner
+    for _, src := range listenerSources {
+        file, err := os.Open(src.path)
+        if err != nil {
+            continue
+        }
+        scanner := bufio.NewScanner(file)
+        scanner.Scan()
+        for scanner.Scan() {
+            fields := strings.Fields(scanner.Text())
+            if len(fields) < 10 || fields[3] != src.state || !strings.HasSuffix(fields[2], ":0000") {
+                continue
+            }
+            host, port, err := net.SplitHostPort(parseAddr(fields[1]))
+            if err != nil {
+                continue
+            }
+            l := models.Listener{Protocol: src.protocol, Family: src.family, Address: host}
+            l.Port, _ = strconv.Atoi(port)
+            l.UID, _ = strconv.Atoi(fields[7])
+            if _, seen := listeners[listenerKey(l)]; seen {
+                continue
+            }
+
+            if owners == nil {
+                owners = socketOwners()
+            }
+            inode, _ := strconv.ParseUint(fields[9], 10, 64)
+            if owner, ok := owners[inode]; ok {
+                l.PID = owner.pid
+                l.Process = owner.name
+                l.Exe, _ = os.Readlink("/proc/" + strconv.Itoa(owner.pid) + "/exe")
+                l.Unit, l.Runtime, l.Container = processCgroup(owner.pid)
+            }
+            listeners[listenerKey(l)] = l
+        }
+        file.Close()
+    }
+    return listeners
+}
+
+// processCgroup derives the systemd unit, or the container runtime and
+// short container ID, from the cgroup a process belongs to.
+func processCgroup(pid int) (unit, runtime, container string) {
+    data, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/cgroup")
+    if err != nil {
+        return "", "", ""
+    }
+    // Prefer the unified hierarchy, then the systemd named one.
+    path := ""
+    for _, line := range strings.Split(string(data), "\n") {
+        if p, ok := strings.CutPrefix(line, "0::"); ok {
+            path = p
+            break
+        }
+        if p, ok := strings.CutPrefix(line, "1:name=systemd:"); ok {
+            path = p
+        }
+    }
+
+    if id := containerIDPattern.FindString(path); id != "" {
+        for _, r := range containerRuntimes {
+            if strings.Contains(path, r.fragment) {
+                runtime = r.runtime
+                break
+            }
+        }
+        return "", runtime, id[:12]
+    }
+    segments := strings.Split(path, "/")
+    for i := len(segments) - 1; i >= 0; i-- {
+        if strings.HasSuffix(segments[i], ".service") {
+            return segments[i], "", ""
+        }
+    }
+    return "", "", ""
+}
+
+func sortListeners(listeners []models.Listener) {
+    sort.Slice(listeners, func(i, j int) bool {
+        a, b := listeners[i], listeners[j]
+        if a.Port != b.Port {
+            return a.Port < b.Port
+        }
+        if a.Protocol != b.Protocol {
+            return a.Protocol < b.Protocol
+        }
+        return a.Address < b.Address
+    })
+}
+
+// StartListenerScans scans the listening ports now and then at a fixed
+// interval, recording what changed between scans.
+func StartListenerScans() {
+    recordListenerScan(time.Now(), scanListeners())
+    go func() {
+        ticker := time.NewTicker(listenerScanInterval)
+        defer ticker.Stop()
+        for now := range ticker.C {
+            recordListenerScan(now, scanListeners())
+        }
+    }()
+}
+
+func recordListenerScan(now time.Time, current map[string]models.Listener) {
+    listenersMutex.Lock()
+    defer listenersMutex.Unlock()
+
+    if lastListeners == nil {
+        firstListenerScan = now
+    } else {
+        for key, l := range current {
+            if _, existed := lastListeners[key]; !existed {
+                listenerChanges = append(listenerChanges, listenerChange{time: now, key: key, added: true, listener: l})
+            }
+        }
+        for key, l := range lastListeners {
+            if _, exists := current[key]; !exists {
+                listenerChanges = append(listenerChanges, listenerChange{time: now, key: key, listener: l})
+            }
+        }
+    }
+    lastListeners, lastListenerScan, previousListenerScan = current, now, lastListenerScan
+
+    drop := 0
+    for drop < len(listenerChanges) && now.Sub(listenerChanges[drop].time) > listenerChangeRetention {
+        drop++
+    }
+    drop = max(drop, len(listenerChanges)-maxListenerChanges)
+    if drop > 0 {
+        firstListenerScan = listenerChanges[drop-1].time
+        listenerChanges = append([]listenerChange(nil), listenerChanges[drop:]...)
+    }
+}
+
+// GetListeners lists the listening ports as of the latest scan and which
+// were added or removed since ?since=, the timestamp of an earlier
+// response. Without it the changes of the latest scan are reported, and a
+// since older than the retained changes is moved up to the oldest one.
+func GetListeners(w http.ResponseWriter, r *http.Request) {
+    var since time.Time
+    if v := r.URL.Query().Get("since"); v != "" {
+        t, err := time.Parse(time.RFC3339, v)
+        if err != nil {
+            writeError(w, http.StatusBadRequest, "since must be an RFC 3339 timestamp")
+            return
+        }
+        since = t
+    }
+
+    listenersMutex.Lock()
+    if lastListeners == nil {
+        listenersMutex.Unlock()
+        writeError(w, http.StatusServiceUnavailable, "Listening ports have not been scanned yet")
+        return
+    }
+    current, scanned := lastListeners, lastListenerScan
+    if since.IsZero() {
+        since = previousListenerScan
+    }
+    if since.Before(firstListenerScan) {
+        since = firstListenerScan
+    }
+    // Only the first change of a port after since says whether it existed
+    // back then.
+    before := make(map[string]listenerChange)
+    for _, c := range listenerChanges {
+        if _, seen := before[c.key]; !seen && c.time.After(since) {
+            before[c.key] = c
+        }
+    }
+    listenersMutex.Unlock()
+
+    inventory := models.ListenerInventory{
+        Timestamp: scanned.Format(time.RFC3339Nano),
+        Since:     since.Format(time.RFC3339Nano),
+        Listeners: []models.Listener{},
+        Added:     []models.Listener{},
+        Removed:   []models.Listener{},
+    }
+    for _, l := range current {
+        inventory.Listeners = append(inventory.Listeners, l)
+    }
+    for key, c := range before {
+        _, exists := current[key]
+        switch {
+        case c.added && exists:
+            inventory.Added = append(inventory.Added, current[key])
+        case !c.added && !exists:
+            inventory.Removed = append(inventory.Removed, c.listener)
+        }
+    }
+    sortListeners(inventory.Listeners)
+    sortListeners(inventory.Added)
+    sortListeners(inventory.Removed)
+    writeJSON(w, http.StatusOK, inventory)
+}
@@ -0,0 +1,221 @@
+package handlers
+
+import (
+    "bufio"
+    "encoding/hex"
+    "net"
+    "net/http"
+    "os"
+    "strconv"
+    "strings"
+
+    "netron/models"
+    "netron/netlink"
+)
+
+// Route flags from linux/route.h and linux/ipv6_route.h.
+const (
+    rtfGateway = 0x0002
+    rtfReject  = 0x0200
+    rtfCache   = 0x01000000
+    rtfLocal   = 0x80000000
+)
+
+const systemdResolvedStub = "127.0.0.53"
+
+// readIPv4Routes parses /proc/net/route, whose addresses are hexadecimal in
+// host byte order.
+func readIPv4Routes() []models.Route {
+    file, err := os.Open("/proc/net/route")
+    if err != nil {
+        return nil
+    }
+    defer file.Close()
+
+    var routes []models.Route
+    scanner := bufio.NewScanner(file)
+    scanner.Scan()
+    for scanner.Scan() {
+        fields := strings.Fields(scanner.Text())
+        if len(fields) < 11 {
+            continue
+        }
+        flags, _ := strconv.ParseUint(fields[3], 16, 32)
+        metric, _ := strconv.Atoi(fields[6])
+        mtu, _ := strconv.Atoi(fields[8])
+        dst, gw, mask := parseHexIPv4(fields[1]), parseHexIPv4(fields[2]), parseHexIPv4(fields[7])
+        if dst == nil || gw == nil || mask == nil {
+            continue
+        }
+        ones, _ := net.IPMask(mask).Size()
+
+        route := models.Route{
+            Family:      "ipv4",
+            Destination: (&net.IPNet{IP: dst, Mask: net.IPMask(mask)}).String(),
+            Interface:   fields[0],
+            Metric:      metric,
+            MTU:         mtu,
+            Default:     ones == 0,
+        }
+        if flags&rtfGateway != 0 {
+            route.Gateway = gw.String()
+        }
+        routes = append(routes, route)
+    }
+    return routes
+}
+
+func parseHexIPv4(s string) net.IP {
+    n, err := strconv.ParseUint(s, 16, 32)
+    if err != nil {
+        return nil
+    }
+    return net.IPv4(byte(n), byte(n>>8), byte(n>>16), byte(n>>24)).To4()
+}
+
+// readIPv6Routes parses /proc/net/ipv6_route, whose addresses are in
+// network byte order. It covers every routing table, so local, cached and
+// rejecting routes are left out to match the main table.
+func readIPv6Routes() []models.Route {
+    file, err := os.Open("/proc/net/ipv6_route")
+    if err != nil {
+        return nil
+    }
+    defer file.Close()
+
+    var routes []models.Route
+    scanner := bufio.NewScanner(file)
+    for scanner.Scan() {
+        fields := strings.Fields(scanner.Text())
+        if len(fields) < 10 {
+            continue
+        }
+        flags, _ := strconv.ParseUint(fields[8], 16, 32)
+        if flags&(rtfLocal|rtfCache|rtfReject) != 0 {
+            continue
+        }
+        dst, err1 := hex.DecodeString(fields[0])
+        prefix, err2 := strconv.ParseUint(fields[1], 16, 8)
+        gw, err3 := hex.DecodeString(fields[4])
+        metric, err4 := strconv.ParseUint(fields[5], 16, 32)
+        if err1 != nil || err2 != nil || err3 != nil || err4 != nil || len(dst) != net.IPv6len || len(gw) != net.IPv6len {
+            continue
+        }
+        if net.IP(dst).IsMulticast() {
+            continue
+        }
+
+        route := models.Route{
+            Family:      "ipv6",
+            Destination: (&net.IPNet{IP: dst, Mask: net.CIDRMask(int(prefix), 128)}).String(),
+            Interface:   fields[9],
+            Metric:      int(metric),
+            Default:     prefix == 0,
+        }
+        if !net.IP(gw).IsUnspecified() {
+            route.Gateway = net.IP(gw).String()
+        }
+        routes = append(routes, route)
+    }
+    return routes
+}
+
+// readResolvConf parses the resolvers of a resolv.conf file.
+func readResolvConf(path string) (nameservers, search, options []string) {
+    file, err := os.Open(path)
+    if err != nil {
+        return nil, nil, nil
+    }
+    defer file.Close()
+
+    scanner := bufio.NewScanner(file)
+    for scanner.Scan() {
+        fields := strings.Fields(scanner.Text())
+        if len(fields) < 2 || strings.HasPrefix(fields[0], "#") || strings.HasPrefix(fields[0], ";") {
+            continue
+        }
+        switch fields[0] {
+        case "nameserver":
+            nameservers = append(nameservers, fields[1])
+        case "search", "domain":
+            search = append(search, fields[1:]...)
+        case "options":
+            options = append(options, fields[1:]...)
+        }
+    }
+    return nameservers, search, options
+}
+
+func getDNSConfig() models.DNSConfig {
+    var dns models.DNSConfig
+    dns.Nameservers, dns.Search, dns.Options = readResolvConf("/etc/resolv.conf")
+    if dns.Nameservers == nil {
+        dns.Nameservers = []string{}
+    }
+    // Behind the systemd-resolved stub the real resolvers are listed in a
+    // file of their own.
+    if containsString(dns.Nameservers, systemdResolvedStub) {
+        dns.Upstream, _, _ = readResolvConf("/run/systemd/resolve/resolv.conf")
+    }
+    return dns
+}
+
+func getNeighbors() ([]models.Neighbor, error) {
+    entries, err := netlink.Neighbors()
+    if err != nil {
+        return nil, err
+    }
+    names := make(map[int]string)
+    if ifaces, err := net.Interfaces(); err == nil {
+        for _, iface := range ifaces {
+            names[iface.Index] = iface.Name
+        }
+    }
+
+    // Like ip neigh, leave out the entries of interfaces without address
+    // resolution, such as loopback and multicast addresses.
+    neighbors := make([]models.Neighbor, 0, len(entries))
+    for _, e := range entries {
+        if e.State == "noarp" {
+            continue
+        }
+        n := models.Neighbor{
+            Family:    "ipv4",
+            IP:        e.IP.String(),
+            MAC:       e.MAC.String(),
+            Interface: names[e.Ifindex],
+            State:     e.State,
+            Router:    e.IsRouter,
+        }
+        if e.IP.Is6() {
+            n.Family = "ipv6"
+        }
+        neighbors = append(neighbors, n)
+    }
+    return neighbors, nil
+}
+
+// GetNetworkConfig reports the routing tables, default gateways, neighbour
+// caches and DNS resolvers of the host.
+func GetNetworkConfig(w http.ResponseWriter, r *http.Request) {
+    config := models.NetworkConfig{
+        Routes:    append(readIPv4Routes(), readIPv6Routes()...),
+        Gateways:  []models.Route{},
+        Neighbors: []models.Neighbor{},
+        DNS:       getDNSConfig(),
+    }
+    if config.Routes == nil {
+        config.Routes = []models.Route{}
+    }
+    for _, route := range config.Routes {
+        if route.Default && route.Gateway != "" {
+            config.Gateways = append(config.Gateways, route)
+        }
+    }
+    if neighbors, err := getNeighbors(); err != nil {
+        config.Error = "neighbours: " + err.Error()
+    } else {
+        config.Neighbors = neighbors
+    }
+    writeJSON(w, http.StatusOK, config)
+}
@@ -0,0 +1,225 @@
+package handlers
+
+import (
+    "bufio"
+    "log"
+    "net/http"
+    "os"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "netron/models"
+)
+
+const netStatInterval = 10 * time.Second
+
+// keyNetCounters are the counters reported by default, chosen to show
+// loss, overload and misbehaving peers. Gauges have no rate.
+var keyNetCounters = []struct {
+    name        string
+    description string
+    gauge       bool
+}{
+    {"Tcp.CurrEstab", "Established TCP connections", true},
+    {"Tcp.ActiveOpens", "Outgoing TCP connections opened", false},
+    {"Tcp.PassiveOpens", "Incoming TCP connections accepted", false},
+    {"Tcp.AttemptFails", "TCP connection attempts that failed", false},
+    {"Tcp.EstabResets", "Established TCP connections reset", false},
+    {"Tcp.InSegs", "TCP segments received", false},
+    {"Tcp.OutSegs", "TCP segments sent", false},
+    {"Tcp.RetransSegs", "TCP segments retransmitted", false},
+    {"Tcp.InErrs", "TCP segments received with errors", false},
+    {"Tcp.OutRsts", "TCP resets sent", false},
+    {"TcpExt.TCPTimeouts", "TCP retransmission timeouts", false},
+    {"TcpExt.ListenOverflows", "Connections dropped because an accept queue was full", false},
+    {"TcpExt.ListenDrops", "Connections dropped by listening sockets", false},
+    {"TcpExt.SyncookiesSent", "SYN cookies sent because a SYN queue was full", false},
+    {"TcpExt.SyncookiesRecv", "Valid SYN cookies received", false},
+    {"TcpExt.SyncookiesFailed", "Invalid SYN cookies received", false},
+    {"TcpExt.TCPAbortOnMemory", "TCP connections aborted for lack of memory", false},
+    {"Udp.InDatagrams", "UDP datagrams received", false},
+    {"Udp.OutDatagrams", "UDP datagrams sent", false},
+    {"Udp.NoPorts", "UDP datagrams to closed ports", false},
+    {"Udp.InErrors", "UDP datagrams dropped on receive", false},
+    {"Udp.RcvbufErrors", "UDP datagrams dropped because a receive buffer was full", false},
+    {"Udp.SndbufErrors", "UDP datagrams dropped because a send buffer was full", false},
+    {"Udp6.InErrors", "UDP over IPv6 datagrams dropped on receive", false},
+    {"Udp6.RcvbufErrors", "UDP over IPv6 datagrams dropped because a receive buffer was full", false},
+    {"Ip.InDiscards", "IPv4 packets discarded on receive", false},
+    {"Ip.OutNoRoutes", "IPv4 packets without a route", false},
+    {"Ip6.InDiscards", "IPv6 packets discarded on receive", false},
+    {"Ip6.OutNoRoutes", "IPv6 packets without a route", false},
+}
+
+type netStatSample struct {
+    time     time.Time
+    counters map[string]int64
+}
+
+var (
+    netStatMutex    sync.Mutex
+    netStatPrevious netStatSample
+    netStatLatest   netStatSample
+)
+
+// readNetCounters reads the protocol counters of /proc/net/snmp,
+// /proc/net/netstat and /proc/net/snmp6 as Group.Name, e.g. Tcp.RetransSegs
+// or Ip6.InReceives.
+func readNetCounters() map[string]int64 {
+    counters := make(map[string]int64)
+    for _, path := range []string{"/proc/net/snmp", "/proc/net/netstat"} {
+        readHeaderedCounters(path, counters)
+    }
+
+    // snmp6 has one "Ip6InReceives value" pair per line.
+    file, err := os.Open("/proc/net/snmp6")
+    if err != nil {
+        return counters
+    }
+    defer file.Close()
+    scanner := bufio.NewScanner(file)
+    for scanner.Scan() {
+        fields := strings.Fields(scanner.Text())
+        if len(fields) != 2 {
+            continue
+        }
+        i := strings.IndexByte(fields[0], '6')
+        if i < 0 {
+            continue
+        }
+        if v, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+            counters[fields[0][:i+1]+"."+fields[0][i+1:]] = v
+        }
+    }
+    return counters
+}
+
+// readHeaderedCounters parses files made of line pairs, a "Group: names"
+// header followed by a "Group: values" line.
+func readHeaderedCounters(path string, counters map[string]int64) {
+    file, err := os.Open(path)
+    if err != nil {
+        return
+    }
+    defer file.Close()
+
+    scanner := bufio.NewScanner(file)
+    scanner.Buffer(make([]byte, 64<<10), 1<<20)
+    for scanner.Scan() {
+        names := strings.Fields(scanner.Text())
+        if !scanner.Scan() {
+            break
+        }
+        values := strings.Fields(scanner.Text())
+        if len(names) != len(values) || len(names) == 0 || names[0] != values[0] {
+            continue
+        }
+        group := strings.TrimSuffix(names[0], ":")
+        for i := 1; i < len(names); i++ {
+            if v, err := strconv.ParseInt(values[i], 10, 64); err == nil {
+                counters[group+"."+names[i]] = v
+            }
+        }
+    }
+}
+
+// StartNetStats samples the protocol counters every netStatInterval, so
+// that rates are available, and records the rates of the key counters into
+// the history store as netstat.<Group>.<Name>.
+func StartNetStats() {
+    go func() {
+        ticker := time.NewTicker(netStatInterval)
+        defer ticker.Stop()
+
+        for now := time.Now(); ; now = <-ticker.C {
+            sample := netStatSample{time: now, counters: readNetCounters()}
+            netStatMutex.Lock()
+            netStatPrevious, netStatLatest = netStatLatest, sample
+            previous := netStatPrevious
+            netStatMutex.Unlock()
+
+            if historyStore == nil || previous.counters == nil {
+                continue
+            }
+            for _, c := range keyNetCounters {
+                if rate, ok := counterRate(previous, sample, c.name); ok && !c.gauge {
+                    if err := historyStore.Record("netstat."+c.name, now, rate); err != nil {
+                        log.Printf("history: failed to record netstat.%s: %v", c.name, err)
+                    }
+                }
+            }
+        }
+    }()
+}
+
+// counterRate is the per second increase of a counter between two samples.
+// A counter that went down, because it wrapped or was reset, has no rate.
+func counterRate(previous, latest netStatSample, name string) (float64, bool) {
+    before, ok1 := previous.counters[name]
+    after, ok2 := latest.counters[name]
+    elapsed := latest.time.Sub(previous.time).Seconds()
+    if !ok1 || !ok2 || after < before || elapsed <= 0 {
+        return 0, false
+    }
+    return float64(after-before) / elapsed, true
+}
+
+// GetNetStats reports the key TCP/IP stack counters with their rates over
+// the last sampling interval, or every counter the kernel exposes with
+// ?all=true.
+func GetNetStats(w http.ResponseWriter, r *http.Request) {
+    all := r.URL.Query().Get("all") == "true"
+
+    netStatMutex.Lock()
+    previous, latest := netStatPrevious, netStatLatest
+    netStatMutex.Unlock()
+    if latest.counters == nil {
+        latest = netStatSample{time: time.Now(), counters: readNetCounters()}
+    }
+
+    stats := models.NetStats{
+        Timestamp:     latest.time.Format(time.RFC3339),
+        TCPCongestion: getTCPCongestion(),
+        Counters:      []models.NetCounter{},
+    }
+    if previous.counters != nil {
+        stats.Interval = latest.time.Sub(previous.time).Seconds()
+    }
+    counter := func(name, description string, gauge bool) {
+        value, ok := latest.counters[name]
+        if !ok {
+            return
+        }
+        c := models.NetCounter{Name: name, Value: value, Description: description, Gauge: gauge}
+        if rate, ok := counterRate(previous, latest, name); ok && !gauge {
+            c.Rate = &rate
+        }
+        stats.Counters = append(stats.Counters, c)
+    }
+
+    if all {
+        names := make([]string, 0, len(latest.counters))
+        for name := range latest.counters {
+            names = append(names, name)
+        }
+        sort.Strings(names)
+        for _, name := range names {
+            counter(name, "", false)
+        }
+    } else {
+        for _, c := range keyNetCounters {
+            counter(c.name, c.description, c.gauge)
+        }
+    }
+
+    retrans, ok1 := counterRate(previous, latest, "Tcp.RetransSegs")
+    sent, ok2 := counterRate(previous, latest, "Tcp.OutSegs")
+    if ok1 && ok2 && sent > 0 {
+        ratio := retrans / sent * 100
+        stats.RetransmitPercent = &ratio
+    }
+    writeJSON(w, http.StatusOK, stats)
+}
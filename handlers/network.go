@@ -2,8 +2,10 @@ package handlers
 
 import (
     "bufio"
+    "encoding/binary"
     "fmt"
     "io/ioutil"
+    "net"
     "os"
     "strconv"
     "strings"
@@ -14,9 +16,13 @@ import (
 func getNetworkInfo() models.NetworkInfo {
     tcp := getTCPConnections()
     udp := getUDPConnections()
-    
+    enrichConnections(tcp)
+    enrichConnections(udp)
+    interfaces := getInterfaces()
+    addWireGuardPeers(interfaces)
+
     return models.NetworkInfo{
-        Interfaces: getInterfaces(),
+        Interfaces: interfaces,
         TCP:        tcp,
         UDP:        udp,
         TCPCount:   len(tcp),
@@ -59,11 +65,15 @@ func getInterfaces() []models.InterfaceInfo {
             }
         }
 
+        mtu, _ := strconv.Atoi(readNetClass(name, "mtu"))
         interfaces = append(interfaces, models.InterfaceInfo{
             Name:      name,
             BytesSent: bytesSent,
             BytesRecv: bytesRecv,
             Speed:     speed,
+            Kind:      interfaceKind(name),
+            State:     readNetClass(name, "operstate"),
+            MTU:       mtu,
         })
     }
 
@@ -134,6 +144,20 @@ func parseAddr(addr string) string {
         return fmt.Sprintf("%d.%d.%d.%d:%d", ip1, ip2, ip3, ip4, port)
     }
 
+    // IPv6 addresses are four 32-bit words, each in host byte order.
+    if len(ipHex) == 32 {
+        ip := make(net.IP, net.IPv6len)
+        for i := 0; i < 4; i++ {
+            word, err := strconv.ParseUint(ipHex[i*8:i*8+8], 16, 32)
+            if err != nil {
+                return addr
+            }
+            binary.NativeEndian.PutUint32(ip[i*4:], uint32(word))
+        }
+        port, _ := strconv.ParseUint(portHex, 16, 16)
+        return net.JoinHostPort(ip.String(), strconv.FormatUint(port, 10))
+    }
+
     return addr
 }
 
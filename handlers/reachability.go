@@ -0,0 +1,161 @@
+package handlers
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "net"
+    "strings"
+    "sync"
+    "time"
+
+    "netron/models"
+    "netron/probe"
+)
+
+const (
+    DefaultReachabilityIPv4 = "8.8.8.8,1.1.1.1"
+    DefaultReachabilityIPv6 = "2001:4860:4860::8888,2606:4700:4700::1111"
+    DefaultReachabilityName = "google.com"
+
+    reachabilityTimeout = 3 * time.Second
+)
+
+// ReachabilityConfig configures the connectivity checks. IPv4 and IPv6 are
+// comma separated lists of addresses; each is tried with an ICMP echo, a
+// TCP connection to port 443 and a DNS query for DNSName, and the first to
+// answer is reported.
+type ReachabilityConfig struct {
+    IPv4     string
+    IPv6     string
+    DNSName  string
+    Interval time.Duration
+}
+
+var (
+    reachabilityMutex sync.Mutex
+    ipv4Status        *models.ReachabilityStatus
+    ipv6Status        *models.ReachabilityStatus
+)
+
+func parseReachabilityTargets(list string, v4 bool) ([]net.IP, error) {
+    var ips []net.IP
+    for _, s := range strings.Split(list, ",") {
+        s = strings.TrimSpace(s)
+        if s == "" {
+            continue
+        }
+        ip := net.ParseIP(s)
+        if ip == nil || (ip.To4() != nil) != v4 {
+            family := "IPv6"
+            if v4 {
+                family = "IPv4"
+            }
+            return nil, fmt.Errorf("%q is not an %s address", s, family)
+        }
+        ips = append(ips, ip)
+    }
+    return ips, nil
+}
+
+// StartReachabilityChecks checks both address families every
+// cfg.Interval until the process exits. A family without targets is not
+// checked and reported as null.
+func StartReachabilityChecks(cfg ReachabilityConfig) error {
+    v4, err := parseReachabilityTargets(cfg.IPv4, true)
+    if err != nil {
+        return err
+    }
+    v6, err := parseReachabilityTargets(cfg.IPv6, false)
+    if err != nil {
+        return err
+    }
+    if cfg.Interval < reachabilityTimeout {
+        return fmt.Errorf("the check interval must be at least %s", reachabilityTimeout)
+    }
+    if cfg.DNSName == "" {
+        return errors.New("a DNS name to resolve is required")
+    }
+
+    check := func(targets []net.IP, network string, status **models.ReachabilityStatus) {
+        if len(targets) == 0 {
+            return
+        }
+        ticker := time.NewTicker(cfg.Interval)
+        defer ticker.Stop()
+        for {
+            result := checkReachability(targets, network, cfg.DNSName)
+            reachabilityMutex.Lock()
+            *status = &result
+            reachabilityMutex.Unlock()
+            <-ticker.C
+        }
+    }
+    go check(v4, "4", &ipv4Status)
+    go check(v6, "6", &ipv6Status)
+    return nil
+}
+
+// checkReachability tries every target with every method at once and
+// reports the first success in configuration order. When nothing answers,
+// Error lists why each method failed for the first target.
+func checkReachability(targets []net.IP, family, dnsName string) models.ReachabilityStatus {
+    status := models.ReachabilityStatus{Checked: time.Now().Format(time.RFC3339)}
+
+    methods := []struct {
+        name string
+        run  func(ctx context.Context, ip net.IP) (time.Duration, error)
+    }{
+        {"icmp", func(ctx context.Context, ip net.IP) (time.Duration, error) {
+            return probe.ICMP(ctx, ip, reachabilityTimeout)
+        }},
+        {"tcp", func(ctx context.Context, ip net.IP) (time.Duration, error) {
+            return probe.TCP(ctx, net.JoinHostPort(ip.String(), "443"), reachabilityTimeout)
+        }},
+        {"dns", func(ctx context.Context, ip net.IP) (time.Duration, error) {
+            return probe.DNS(ctx, "udp"+family, net.JoinHostPort(ip.String(), "53"), dnsName, reachabilityTimeout)
+        }},
+    }
+
+    rtts := make([][]time.Duration, len(targets))
+    errs := make([][]error, len(targets))
+    var wg sync.WaitGroup
+    for i, ip := range targets {
+        rtts[i] = make([]time.Duration, len(methods))
+        errs[i] = make([]error, len(methods))
+        for j, m := range methods {
+            wg.Add(1)
+            go func(i, j int, ip net.IP, run func(context.Context, net.IP) (time.Duration, error)) {
+                defer wg.Done()
+                rtts[i][j], errs[i][j] = run(context.Background(), ip)
+            }(i, j, ip, m.run)
+        }
+    }
+    wg.Wait()
+
+    for i, ip := range targets {
+        for j, m := range methods {
+            if errs[i][j] == nil {
+                status.Reachable = true
+                status.Target = ip.String()
+                status.Method = m.name
+                status.RTT = float64(rtts[i][j]) / float64(time.Millisecond)
+                return status
+            }
+        }
+    }
+
+    var reasons []string
+    for j, m := range methods {
+        reasons = append(reasons, m.name+": "+errs[0][j].Error())
+    }
+    status.Target = targets[0].String()
+    status.Error = strings.Join(reasons, "; ")
+    return status
+}
+
+func getReachability() (v4, v6 *models.ReachabilityStatus) {
+    reachabilityMutex.Lock()
+    defer reachabilityMutex.Unlock()
+    return ipv4Status, ipv6Status
+}
@@ -0,0 +1,52 @@
+package handlers
+
+import (
+    "io/ioutil"
+    "os"
+    "strconv"
+    "strings"
+)
+
+type socketOwner struct {
+    pid  int
+    name string
+}
+
+// socketOwners maps socket inodes to the processes holding them, found
+// through the socket:[inode] links in /proc/<pid>/fd. Sockets of processes
+// Netron may not inspect are missing from the map.
+func socketOwners() map[uint64]socketOwner {
+    owners := make(map[uint64]socketOwner)
+    dirs, err := ioutil.ReadDir("/proc")
+    if err != nil {
+        return owners
+    }
+    for _, dir := range dirs {
+        pid, err := strconv.Atoi(dir.Name())
+        if err != nil || !dir.IsDir() {
+            continue
+        }
+        fdDir := "/proc/" + dir.Name() + "/fd"
+        fds, err := ioutil.ReadDir(fdDir)
+        if err != nil {
+            continue
+        }
+        name := ""
+        for _, fd := range fds {
+            link, err := os.Readlink(fdDir + "/" + fd.Name())
+            if err != nil || !strings.HasPrefix(link, "socket:[") {
+                continue
+            }
+            inode, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(link, "socket:["), "]"), 10, 64)
+            if err != nil {
+                continue
+            }
+            if name == "" {
+                comm, _ := ioutil.ReadFile("/proc/" + dir.Name() + "/comm")
+                name = strings.TrimSpace(string(comm))
+            }
+            owners[inode] = socketOwner{pid: pid, name: name}
+        }
+    }
+    return owners
+}
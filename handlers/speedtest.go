@@ -1,11 +1,12 @@
 package handlers
 
 import (
+    "context"
     "encoding/json"
+    "errors"
+    "fmt"
+    "io"
     "net/http"
-    "os/exec"
-    "strconv"
-    "strings"
     "sync"
     "time"
 
@@ -13,9 +14,10 @@ import (
 )
 
 var (
-    speedTestMutex sync.Mutex
-    currentTest    models.SpeedTestInfo
-    isRunning      bool
+    speedTestMutex  sync.Mutex
+    currentTest     models.SpeedTestInfo
+    isRunning       bool
+    cancelSpeedTest context.CancelCauseFunc
 )
 
 func GetSpeedTest(w http.ResponseWriter, r *http.Request) {
@@ -27,83 +29,146 @@ func GetSpeedTest(w http.ResponseWriter, r *http.Request) {
 }
 
 func StartSpeedTest(w http.ResponseWriter, r *http.Request) {
-    speedTestMutex.Lock()
-    if isRunning {
-        speedTestMutex.Unlock()
+    var req models.SpeedTestRequest
+    if r.ContentLength != 0 {
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+            writeError(w, http.StatusBadRequest, "Invalid request: "+err.Error())
+            return
+        }
+    }
+
+    err := startSpeedTest("manual", req)
+    if err == errSpeedTestRunning {
         w.Header().Set("Content-Type", "application/json")
         json.NewEncoder(w).Encode(map[string]string{"error": "Speed test already running"})
         return
     }
+    if err != nil {
+        writeError(w, http.StatusBadRequest, err.Error())
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]string{"status": "started"})
+}
+
+// CancelSpeedTest stops the running speed test. The test ends shortly
+// after with phase "cancelled".
+func CancelSpeedTest(w http.ResponseWriter, r *http.Request) {
+    speedTestMutex.Lock()
+    defer speedTestMutex.Unlock()
+
+    if !isRunning {
+        writeError(w, http.StatusConflict, "No speed test running")
+        return
+    }
+    cancelSpeedTest(errSpeedTestCancelled)
+    writeJSON(w, http.StatusOK, map[string]string{"status": "cancelling"})
+}
+
+var (
+    errSpeedTestRunning   = errors.New("speed test already running")
+    errSpeedTestCancelled = errors.New("speed test cancelled")
+    errSpeedTestTimeout   = errors.New("speed test timed out")
+)
+
+// startSpeedTest launches a speed test in the background. It fails with
+// errSpeedTestRunning if a test is already in progress.
+func startSpeedTest(trigger string, req models.SpeedTestRequest) error {
+    name, backend, err := lookupBackend(req.Backend)
+    if err != nil {
+        return err
+    }
+    if err := checkServerSelection(name, backend, req); err != nil {
+        return err
+    }
+
+    speedTestMutex.Lock()
+    if isRunning {
+        speedTestMutex.Unlock()
+        return errSpeedTestRunning
+    }
+    ctx, cancel := context.WithCancelCause(context.Background())
+    cancelSpeedTest = cancel
     isRunning = true
     currentTest.Running = true
+    currentTest.Backend = name
     currentTest.Error = ""
+    resetProgress()
+    publishSpeedTest()
     speedTestMutex.Unlock()
 
-    go runSpeedTest()
-
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(map[string]string{"status": "started"})
+    go runSpeedTest(ctx, trigger, name, backend, req)
+    return nil
 }
 
-func runSpeedTest() {
+func runSpeedTest(ctx context.Context, trigger, name string, backend SpeedTestBackend, req models.SpeedTestRequest) {
+    status := PhaseComplete
     defer func() {
         speedTestMutex.Lock()
+        cancelSpeedTest(nil)
         isRunning = false
         currentTest.Running = false
+        currentTest.CurrentSpeed = 0
+        currentTest.Phase = status
+        if status == PhaseComplete {
+            currentTest.Progress = 100
+        }
+        publishSpeedTest()
         speedTestMutex.Unlock()
     }()
 
-    cmd := exec.Command("speedtest-cli", "--simple")
-    output, err := cmd.Output()
-    
-    speedTestMutex.Lock()
-    defer speedTestMutex.Unlock()
-
-    if err != nil {
-        currentTest.Error = "Failed to run speedtest-cli: " + err.Error()
-        return
+    if speedTestTimeout > 0 {
+        var stop context.CancelFunc
+        cause := fmt.Errorf("%w after %s", errSpeedTestTimeout, speedTestTimeout)
+        ctx, stop = context.WithTimeoutCause(ctx, speedTestTimeout, cause)
+        defer stop()
     }
 
-    lines := strings.Split(string(output), "\n")
-    for _, line := range lines {
-        line = strings.TrimSpace(line)
-        if strings.HasPrefix(line, "Ping:") {
-            parts := strings.Fields(line)
-            if len(parts) >= 2 {
-                pingStr := strings.TrimSpace(parts[1])
-                if ping, err := strconv.ParseFloat(pingStr, 64); err == nil {
-                    currentTest.Ping = ping
-                }
-            }
-        } else if strings.HasPrefix(line, "Download:") {
-            parts := strings.Fields(line)
-            if len(parts) >= 2 {
-                downloadStr := strings.TrimSpace(parts[1])
-                if download, err := strconv.ParseFloat(downloadStr, 64); err == nil {
-                    currentTest.Download = download
-                }
-            }
-        } else if strings.HasPrefix(line, "Upload:") {
-            parts := strings.Fields(line)
-            if len(parts) >= 2 {
-                uploadStr := strings.TrimSpace(parts[1])
-                if upload, err := strconv.ParseFloat(uploadStr, 64); err == nil {
-                    currentTest.Upload = upload
-                }
+    started := time.Now()
+    result, err := backend.Run(ctx, req, reportProgress)
+    result.Timestamp = started.Format(time.RFC3339)
+    result.Trigger = trigger
+    result.Backend = name
+
+    // The error of an interrupted backend describes what was interrupted,
+    // e.g. the signal that stopped its process; lead with the reason.
+    if err != nil {
+        status = PhaseFailed
+        if cause := context.Cause(ctx); cause != nil {
+            status = PhaseCancelled
+            if errors.Is(cause, errSpeedTestTimeout) {
+                status = PhaseTimeout
             }
+            err = fmt.Errorf("%v: %v", cause, err)
         }
     }
+    result.Status = status
 
-    serverCmd := exec.Command("speedtest-cli", "--list")
-    if serverOutput, err := serverCmd.Output(); err == nil {
-        serverLines := strings.Split(string(serverOutput), "\n")
-        for _, serverLine := range serverLines {
-            if strings.Contains(serverLine, ")") && len(serverLine) > 10 {
-                currentTest.Server = strings.TrimSpace(serverLine)
-                break
-            }
-        }
+    speedTestMutex.Lock()
+    defer speedTestMutex.Unlock()
+
+    if err != nil {
+        currentTest.Error = err.Error()
+        recordSpeedTestResult(models.SpeedTestResult{
+            Timestamp: result.Timestamp,
+            Trigger:   trigger,
+            Backend:   name,
+            Server:    result.Server,
+            ServerID:  result.ServerID,
+            Status:    status,
+            Error:     currentTest.Error,
+        })
+        return
     }
 
+    currentTest.Backend = name
+    currentTest.Ping = result.Ping
+    currentTest.Jitter = result.Jitter
+    currentTest.Download = result.Download
+    currentTest.Upload = result.Upload
+    currentTest.Server = result.Server
+    currentTest.ServerID = result.ServerID
     currentTest.LastUpdated = time.Now().Format("2006-01-02 15:04:05")
-}
\ No newline at end of file
+    recordSpeedTestResult(result)
+}
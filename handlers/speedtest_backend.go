@@ -0,0 +1,469 @@
+package handlers
+
+import (
+    "bufio"
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net"
+    "os/exec"
+    "regexp"
+    "sort"
+    "strconv"
+    "strings"
+    "syscall"
+    "time"
+
+    "netron/models"
+)
+
+const (
+    BackendNative       = "native"
+    BackendSpeedtestCLI = "speedtest-cli"
+    BackendOokla        = "ookla"
+    BackendIperf3       = "iperf3"
+
+    DefaultSpeedTestTimeout = 5 * time.Minute
+
+    // processKillDelay is how long a cancelled command gets to exit after
+    // SIGTERM before it is killed.
+    processKillDelay = 5 * time.Second
+)
+
+// SpeedTestBackend runs one speed test, reporting its phases to progress.
+// req.Server is the backend specific target (a URL, a server ID or a host)
+// and may be empty.
+type SpeedTestBackend interface {
+    Run(ctx context.Context, req models.SpeedTestRequest, progress SpeedTestProgress) (models.SpeedTestResult, error)
+}
+
+// SpeedTestConfig selects the default backend and configures the ones
+// that need a target.
+type SpeedTestConfig struct {
+    Backend      string
+    Timeout      time.Duration
+    Native       NativeSpeedTestConfig
+    Iperf3Server string
+    PeerServer   string
+    PeerSecret   string
+}
+
+var (
+    defaultBackend    = BackendNative
+    speedTestTimeout  = DefaultSpeedTestTimeout
+    speedTestBackends = map[string]SpeedTestBackend{
+        BackendSpeedtestCLI: speedtestCLIBackend{},
+        BackendOokla:        ooklaBackend{},
+        BackendIperf3:       iperf3Backend{},
+        BackendPeer:         peerBackend{},
+    }
+)
+
+func ConfigureSpeedTest(cfg SpeedTestConfig) error {
+    native, err := newNativeBackend(cfg.Native)
+    if err != nil {
+        return err
+    }
+    speedTestBackends[BackendNative] = native
+    speedTestBackends[BackendIperf3] = iperf3Backend{server: cfg.Iperf3Server}
+    speedTestBackends[BackendPeer] = peerBackend{server: cfg.PeerServer, secret: cfg.PeerSecret}
+
+    if cfg.Timeout < 0 {
+        return errors.New("the speed test timeout cannot be negative")
+    }
+    speedTestTimeout = cfg.Timeout
+
+    if _, ok := speedTestBackends[cfg.Backend]; !ok {
+        return fmt.Errorf("unknown speed test backend %q (available: %s)", cfg.Backend, strings.Join(SpeedTestBackendNames(), ", "))
+    }
+    defaultBackend = cfg.Backend
+    return nil
+}
+
+func SpeedTestBackendNames() []string {
+    names := make([]string, 0, len(speedTestBackends))
+    for name := range speedTestBackends {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return names
+}
+
+func lookupBackend(name string) (string, SpeedTestBackend, error) {
+    if name == "" {
+        name = defaultBackend
+    }
+    backend, ok := speedTestBackends[name]
+    if !ok {
+        return "", nil, fmt.Errorf("unknown speed test backend %q", name)
+    }
+    return name, backend, nil
+}
+
+// speedTestCommand prepares a backend command. When ctx is done the
+// command is sent SIGTERM, then killed if it is still running
+// processKillDelay later.
+func speedTestCommand(ctx context.Context, name string, args ...string) *exec.Cmd {
+    cmd := exec.CommandContext(ctx, name, args...)
+    cmd.Cancel = func() error { return cmd.Process.Signal(syscall.SIGTERM) }
+    cmd.WaitDelay = processKillDelay
+    return cmd
+}
+
+// runLines runs a command and hands each line of its standard output to
+// onLine as soon as it is printed. It is stopped like speedTestCommand.
+func runLines(ctx context.Context, name string, args []string, onLine func(string)) error {
+    cmd := speedTestCommand(ctx, name, args...)
+    stdout, err := cmd.StdoutPipe()
+    if err != nil {
+        return err
+    }
+    var stderr strings.Builder
+    cmd.Stderr = &stderr
+    if err := cmd.Start(); err != nil {
+        return err
+    }
+
+    scanner := bufio.NewScanner(stdout)
+    scanner.Buffer(make([]byte, 64<<10), 1<<20)
+    for scanner.Scan() {
+        onLine(scanner.Text())
+    }
+    if err := cmd.Wait(); err != nil {
+        if msg := strings.TrimSpace(stderr.String()); msg != "" {
+            return fmt.Errorf("%v: %s", err, msg)
+        }
+        return err
+    }
+    return nil
+}
+
+func requireCommand(name string) error {
+    if _, err := exec.LookPath(name); err != nil {
+        return fmt.Errorf("%s is not installed", name)
+    }
+    return nil
+}
+
+// speedtestCLIBackend wraps the Python speedtest-cli. server is an
+// optional speedtest.net server ID.
+type speedtestCLIBackend struct{}
+
+// speedtestCLIResult is the part of speedtest-cli --json output we use.
+// Bandwidth is in bits per second and the server ID is a string.
+type speedtestCLIResult struct {
+    Download float64 `json:"download"`
+    Upload   float64 `json:"upload"`
+    Ping     float64 `json:"ping"`
+    Server   struct {
+        ID       string  `json:"id"`
+        Sponsor  string  `json:"sponsor"`
+        Name     string  `json:"name"`
+        Country  string  `json:"country"`
+        Host     string  `json:"host"`
+        Distance float64 `json:"d"`
+    } `json:"server"`
+}
+
+func (speedtestCLIBackend) Run(ctx context.Context, req models.SpeedTestRequest, progress SpeedTestProgress) (models.SpeedTestResult, error) {
+    var result models.SpeedTestResult
+    if err := requireCommand("speedtest-cli"); err != nil {
+        return result, err
+    }
+
+    args := []string{"--json"}
+    if req.Server != "" {
+        args = append(args, "--server", req.Server)
+    }
+    for _, id := range req.Exclude {
+        args = append(args, "--exclude", id)
+    }
+
+    // --json prints nothing until the test is over, so the only phase we
+    // can report is the first one.
+    progress(PhaseSelectingServer, 0, 0)
+    var parsed *speedtestCLIResult
+    err := runLines(ctx, "speedtest-cli", args, func(line string) {
+        var r speedtestCLIResult
+        if json.Unmarshal([]byte(line), &r) == nil {
+            parsed = &r
+        }
+    })
+    if err != nil {
+        return result, fmt.Errorf("Failed to run speedtest-cli: %v", err)
+    }
+    if parsed == nil {
+        return result, errors.New("speedtest-cli produced no result")
+    }
+
+    result.Ping = parsed.Ping
+    result.Download = parsed.Download / 1e6
+    result.Upload = parsed.Upload / 1e6
+    result.ServerID = parsed.Server.ID
+    result.Server = formatServer(models.SpeedTestServer{
+        Name:     parsed.Server.Sponsor,
+        Location: parsed.Server.Name,
+        Country:  parsed.Server.Country,
+    })
+    return result, nil
+}
+
+// speedtestCLIServer matches a line of speedtest-cli --list, e.g.
+// "12345) Example ISP (Town, Country) [12.34 km]".
+var speedtestCLIServer = regexp.MustCompile(`^\s*(\d+)\)\s+(.*)\s+\((.*)\)\s+\[([\d.]+) km\]`)
+
+// Servers lists the speedtest.net servers closest to us. speedtest-cli does
+// not print server hosts, so no latency is measured.
+func (speedtestCLIBackend) Servers(ctx context.Context) ([]models.SpeedTestServer, error) {
+    if err := requireCommand("speedtest-cli"); err != nil {
+        return nil, err
+    }
+
+    var servers []models.SpeedTestServer
+    err := runLines(ctx, "speedtest-cli", []string{"--list"}, func(line string) {
+        m := speedtestCLIServer.FindStringSubmatch(line)
+        if m == nil {
+            return
+        }
+        server := models.SpeedTestServer{ID: m[1], Name: m[2], Location: m[3]}
+        if i := strings.LastIndex(m[3], ", "); i >= 0 {
+            server.Location, server.Country = m[3][:i], m[3][i+2:]
+        }
+        server.Distance, _ = strconv.ParseFloat(m[4], 64)
+        servers = append(servers, server)
+    })
+    if err != nil {
+        return nil, fmt.Errorf("Failed to run speedtest-cli: %v", err)
+    }
+    return servers, nil
+}
+
+// ooklaBackend wraps Ookla's official speedtest CLI. server is an optional
+// speedtest.net server ID.
+type ooklaBackend struct{}
+
+type ooklaEvent struct {
+    Type string `json:"type"`
+    Ping struct {
+        Progress float64 `json:"progress"`
+    } `json:"ping"`
+    Download struct {
+        Bandwidth float64 `json:"bandwidth"`
+        Progress  float64 `json:"progress"`
+    } `json:"download"`
+    Upload struct {
+        Bandwidth float64 `json:"bandwidth"`
+        Progress  float64 `json:"progress"`
+    } `json:"upload"`
+}
+
+type ooklaResult struct {
+    Ping struct {
+        Jitter  float64 `json:"jitter"`
+        Latency float64 `json:"latency"`
+    } `json:"ping"`
+    Download struct {
+        Bandwidth float64 `json:"bandwidth"`
+    } `json:"download"`
+    Upload struct {
+        Bandwidth float64 `json:"bandwidth"`
+    } `json:"upload"`
+    Server struct {
+        ID       int    `json:"id"`
+        Name     string `json:"name"`
+        Location string `json:"location"`
+        Country  string `json:"country"`
+    } `json:"server"`
+}
+
+func (ooklaBackend) Run(ctx context.Context, req models.SpeedTestRequest, progress SpeedTestProgress) (models.SpeedTestResult, error) {
+    var result models.SpeedTestResult
+    server := req.Server
+    if err := requireCommand("speedtest"); err != nil {
+        return result, err
+    }
+
+    // The Ookla CLI cannot exclude servers, so when asked to we pick the
+    // server ourselves.
+    if server == "" && len(req.Exclude) > 0 {
+        progress(PhaseSelectingServer, 0, 0)
+        picked, err := pickServer(ctx, ooklaBackend{}, req.Exclude)
+        if err != nil {
+            return result, err
+        }
+        server = picked.ID
+    }
+
+    args := []string{"--format=jsonl", "--progress=yes", "--accept-license", "--accept-gdpr"}
+    if server != "" {
+        args = append(args, "--server-id="+server)
+    }
+
+    // With jsonl output the CLI emits a progress event per update and a
+    // final event of type "result".
+    progress(PhaseSelectingServer, 0, 0)
+    var parsed *ooklaResult
+    err := runLines(ctx, "speedtest", args, func(line string) {
+        var event ooklaEvent
+        if json.Unmarshal([]byte(line), &event) != nil {
+            return
+        }
+        switch event.Type {
+        case "ping":
+            progress(PhasePing, 10*event.Ping.Progress, 0)
+        case "download":
+            progress(PhaseDownload, 10+45*event.Download.Progress, event.Download.Bandwidth*8/1e6)
+        case "upload":
+            progress(PhaseUpload, 55+45*event.Upload.Progress, event.Upload.Bandwidth*8/1e6)
+        case "result":
+            parsed = &ooklaResult{}
+            json.Unmarshal([]byte(line), parsed)
+        }
+    })
+    if err != nil {
+        return result, fmt.Errorf("Failed to run speedtest: %v", err)
+    }
+    if parsed == nil {
+        return result, errors.New("speedtest produced no result")
+    }
+
+    // Ookla reports bandwidth in bytes per second.
+    result.Ping = parsed.Ping.Latency
+    result.Jitter = parsed.Ping.Jitter
+    result.Download = parsed.Download.Bandwidth * 8 / 1e6
+    result.Upload = parsed.Upload.Bandwidth * 8 / 1e6
+    result.ServerID = strconv.Itoa(parsed.Server.ID)
+    result.Server = formatServer(models.SpeedTestServer{
+        Name:     parsed.Server.Name,
+        Location: parsed.Server.Location,
+        Country:  parsed.Server.Country,
+    })
+    return result, nil
+}
+
+type ooklaServerList struct {
+    Servers []struct {
+        ID       int    `json:"id"`
+        Host     string `json:"host"`
+        Port     int    `json:"port"`
+        Name     string `json:"name"`
+        Location string `json:"location"`
+        Country  string `json:"country"`
+    } `json:"servers"`
+}
+
+// Servers lists the servers the Ookla CLI would choose from, with the TCP
+// connect time to each.
+func (ooklaBackend) Servers(ctx context.Context) ([]models.SpeedTestServer, error) {
+    if err := requireCommand("speedtest"); err != nil {
+        return nil, err
+    }
+
+    cmd := speedTestCommand(ctx, "speedtest", "--servers", "--format=json", "--accept-license", "--accept-gdpr")
+    output, err := cmd.Output()
+    if err != nil {
+        return nil, fmt.Errorf("Failed to run speedtest: %v", err)
+    }
+    var list ooklaServerList
+    if err := json.Unmarshal(output, &list); err != nil {
+        return nil, fmt.Errorf("Failed to parse speedtest server list: %v", err)
+    }
+
+    servers := make([]models.SpeedTestServer, 0, len(list.Servers))
+    for _, s := range list.Servers {
+        servers = append(servers, models.SpeedTestServer{
+            ID:       strconv.Itoa(s.ID),
+            Name:     s.Name,
+            Location: s.Location,
+            Country:  s.Country,
+            Host:     net.JoinHostPort(s.Host, strconv.Itoa(s.Port)),
+        })
+    }
+    probeServers(ctx, servers)
+    return servers, nil
+}
+
+// iperf3Backend runs iperf3 against one of our own servers. server is
+// host or host:port and defaults to the configured --iperf3-server.
+type iperf3Backend struct {
+    server string
+}
+
+type iperf3Result struct {
+    End struct {
+        Streams []struct {
+            Sender struct {
+                MeanRTT float64 `json:"mean_rtt"`
+            } `json:"sender"`
+        } `json:"streams"`
+        SumReceived struct {
+            BitsPerSecond float64 `json:"bits_per_second"`
+        } `json:"sum_received"`
+    } `json:"end"`
+    Error string `json:"error"`
+}
+
+func (b iperf3Backend) Run(ctx context.Context, req models.SpeedTestRequest, progress SpeedTestProgress) (models.SpeedTestResult, error) {
+    var result models.SpeedTestResult
+    server := req.Server
+    if err := requireCommand("iperf3"); err != nil {
+        return result, err
+    }
+
+    if server == "" {
+        server = b.server
+    }
+    if server == "" {
+        return result, errors.New("no iperf3 server configured")
+    }
+    host, port := server, ""
+    if h, p, err := net.SplitHostPort(server); err == nil {
+        host, port = h, p
+    }
+    result.Server = server
+
+    // iperf3 only prints its JSON report at the end of a run.
+    progress(PhaseUpload, 0, 0)
+    upload, err := runIperf3(ctx, host, port, false)
+    if err != nil {
+        return result, err
+    }
+    progress(PhaseDownload, 50, upload.End.SumReceived.BitsPerSecond/1e6)
+    download, err := runIperf3(ctx, host, port, true)
+    if err != nil {
+        return result, err
+    }
+
+    result.Upload = upload.End.SumReceived.BitsPerSecond / 1e6
+    result.Download = download.End.SumReceived.BitsPerSecond / 1e6
+    // iperf3 reports the sender's smoothed RTT in microseconds.
+    if streams := upload.End.Streams; len(streams) > 0 {
+        result.Ping = streams[0].Sender.MeanRTT / 1000
+    }
+    return result, nil
+}
+
+func runIperf3(ctx context.Context, host, port string, reverse bool) (*iperf3Result, error) {
+    args := []string{"-c", host, "-J"}
+    if port != "" {
+        args = append(args, "-p", port)
+    }
+    if reverse {
+        args = append(args, "-R")
+    }
+
+    // iperf3 exits non-zero on failure but still prints JSON with an error.
+    output, runErr := speedTestCommand(ctx, "iperf3", args...).Output()
+    var parsed iperf3Result
+    if err := json.Unmarshal(output, &parsed); err != nil {
+        if runErr != nil {
+            return nil, fmt.Errorf("Failed to run iperf3: %v", runErr)
+        }
+        return nil, fmt.Errorf("Failed to parse iperf3 output: %v", err)
+    }
+    if parsed.Error != "" {
+        return nil, fmt.Errorf("iperf3: %s", parsed.Error)
+    }
+    return &parsed, nil
+}
@@ -0,0 +1,305 @@
+package handlers
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/json"
+    "io"
+    "log"
+    "math"
+    "net/http"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "sync"
+    "time"
+
+    "netron/models"
+)
+
+const (
+    defaultHistoryLimit = 50
+    maxHistoryLimit     = 500
+    // Lines of the results file longer than this are skipped. Results with
+    // a full minute of peer intervals in both directions stay far below it.
+    maxResultLine = 1 << 20
+)
+
+var (
+    resultsMutex sync.Mutex
+    resultsPath  string
+    results      []models.SpeedTestResult
+)
+
+// OpenSpeedTestHistory loads previously recorded speed test results from
+// path and appends every new result to it. The most recent result becomes
+// the current one, so the dashboard survives restarts.
+func OpenSpeedTestHistory(path string) error {
+    if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+        return err
+    }
+
+    file, err := os.Open(path)
+    if err != nil && !os.IsNotExist(err) {
+        return err
+    }
+
+    var loaded []models.SpeedTestResult
+    if file != nil {
+        defer file.Close()
+        if loaded, err = readResults(file); err != nil {
+            return err
+        }
+    }
+
+    resultsMutex.Lock()
+    resultsPath = path
+    results = loaded
+    resultsMutex.Unlock()
+
+    if len(loaded) > 0 {
+        last := loaded[len(loaded)-1]
+        speedTestMutex.Lock()
+        currentTest = models.SpeedTestInfo{
+            Backend:     last.Backend,
+            Download:    last.Download,
+            Upload:      last.Upload,
+            Ping:        last.Ping,
+            Jitter:      last.Jitter,
+            Server:      last.Server,
+            LastUpdated: resultTime(last).Format("2006-01-02 15:04:05"),
+            Error:       last.Error,
+        }
+        speedTestMutex.Unlock()
+    }
+    return nil
+}
+
+// readResults parses one result per line. Lines that are not a result, such
+// as a torn last line from a crash or an oversized one, are skipped rather
+// than fatal, so a single bad line cannot turn off the history.
+func readResults(r io.Reader) ([]models.SpeedTestResult, error) {
+    var loaded []models.SpeedTestResult
+    skipped := 0
+    reader := bufio.NewReaderSize(r, maxResultLine)
+    for {
+        line, err := reader.ReadSlice('\n')
+        if err == bufio.ErrBufferFull {
+            for err == bufio.ErrBufferFull {
+                _, err = reader.ReadSlice('\n')
+            }
+            skipped++
+        } else if len(bytes.TrimSpace(line)) > 0 {
+            var result models.SpeedTestResult
+            if json.Unmarshal(line, &result) == nil {
+                loaded = append(loaded, result)
+            } else {
+                skipped++
+            }
+        }
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            return nil, err
+        }
+    }
+    if skipped > 0 {
+        log.Printf("Skipped %d unreadable lines of the speed test history", skipped)
+    }
+    return loaded, nil
+}
+
+func recordSpeedTestResult(result models.SpeedTestResult) {
+    resultsMutex.Lock()
+    defer resultsMutex.Unlock()
+
+    if len(results) > 0 {
+        result.ID = results[len(results)-1].ID + 1
+    } else {
+        result.ID = 1
+    }
+    results = append(results, result)
+
+    if resultsPath == "" {
+        return
+    }
+    if err := appendResult(resultsPath, result); err != nil {
+        log.Printf("Failed to store speed test result %d in %s: %v", result.ID, resultsPath, err)
+    }
+}
+
+// appendResult writes result as one line to the end of path and waits for
+// it to reach the disk.
+func appendResult(path string, result models.SpeedTestResult) error {
+    data, err := json.Marshal(result)
+    if err != nil {
+        return err
+    }
+    file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+    if err != nil {
+        return err
+    }
+    if _, err := file.Write(append(data, '\n')); err != nil {
+        file.Close()
+        return err
+    }
+    if err := file.Sync(); err != nil {
+        file.Close()
+        return err
+    }
+    return file.Close()
+}
+
+func resultTime(result models.SpeedTestResult) time.Time {
+    t, _ := time.Parse(time.RFC3339, result.Timestamp)
+    return t
+}
+
+// resultsBetween returns a copy of the results recorded in [from, to],
+// oldest first.
+func resultsBetween(from, to time.Time) []models.SpeedTestResult {
+    resultsMutex.Lock()
+    defer resultsMutex.Unlock()
+
+    var matched []models.SpeedTestResult
+    for _, result := range results {
+        t := resultTime(result)
+        if t.Before(from) || t.After(to) {
+            continue
+        }
+        matched = append(matched, result)
+    }
+    return matched
+}
+
+func parseRangeParams(r *http.Request) (time.Time, time.Time, error) {
+    now := time.Now()
+    query := r.URL.Query()
+    to, err := parseTimeParam(query.Get("to"), now, now)
+    if err != nil {
+        return time.Time{}, time.Time{}, err
+    }
+    from, err := parseTimeParam(query.Get("from"), time.Time{}, now)
+    if err != nil {
+        return time.Time{}, time.Time{}, err
+    }
+    return from, to, nil
+}
+
+func GetSpeedTestHistory(w http.ResponseWriter, r *http.Request) {
+    from, to, err := parseRangeParams(r)
+    if err != nil {
+        writeError(w, http.StatusBadRequest, "Invalid time range: "+err.Error())
+        return
+    }
+
+    page, limit := 1, defaultHistoryLimit
+    if p := r.URL.Query().Get("page"); p != "" {
+        if page, err = strconv.Atoi(p); err != nil || page < 1 {
+            writeError(w, http.StatusBadRequest, "Invalid page")
+            return
+        }
+    }
+    if l := r.URL.Query().Get("limit"); l != "" {
+        if limit, err = strconv.Atoi(l); err != nil || limit < 1 {
+            writeError(w, http.StatusBadRequest, "Invalid limit")
+            return
+        }
+        if limit > maxHistoryLimit {
+            limit = maxHistoryLimit
+        }
+    }
+
+    matched := resultsBetween(from, to)
+    // Newest first.
+    for i, j := 0, len(matched)-1; i < j; i, j = i+1, j-1 {
+        matched[i], matched[j] = matched[j], matched[i]
+    }
+
+    start := (page - 1) * limit
+    if start > len(matched) {
+        start = len(matched)
+    }
+    end := start + limit
+    if end > len(matched) {
+        end = len(matched)
+    }
+
+    writeJSON(w, http.StatusOK, models.SpeedTestHistory{
+        Total:   len(matched),
+        Page:    page,
+        Limit:   limit,
+        Results: append([]models.SpeedTestResult{}, matched[start:end]...),
+    })
+}
+
+func GetSpeedTestSummary(w http.ResponseWriter, r *http.Request) {
+    from, to, err := parseRangeParams(r)
+    if err != nil {
+        writeError(w, http.StatusBadRequest, "Invalid time range: "+err.Error())
+        return
+    }
+
+    type day struct {
+        summary                        models.SpeedTestDaySummary
+        ping, jitter, download, upload []float64
+    }
+    days := make(map[string]*day)
+    for _, result := range resultsBetween(from, to) {
+        // A cancelled run says nothing about the connection.
+        if result.Status == PhaseCancelled {
+            continue
+        }
+        date := resultTime(result).Local().Format("2006-01-02")
+        d, ok := days[date]
+        if !ok {
+            d = &day{summary: models.SpeedTestDaySummary{Date: date}}
+            days[date] = d
+        }
+        d.summary.Runs++
+        if result.Error != "" {
+            d.summary.Failures++
+            continue
+        }
+        d.ping = append(d.ping, result.Ping)
+        d.jitter = append(d.jitter, result.Jitter)
+        d.download = append(d.download, result.Download)
+        d.upload = append(d.upload, result.Upload)
+    }
+
+    summaries := make([]models.SpeedTestDaySummary, 0, len(days))
+    for _, d := range days {
+        d.summary.Ping = computeStats(d.ping)
+        d.summary.Jitter = computeStats(d.jitter)
+        d.summary.Download = computeStats(d.download)
+        d.summary.Upload = computeStats(d.upload)
+        summaries = append(summaries, d.summary)
+    }
+    sort.Slice(summaries, func(i, j int) bool { return summaries[i].Date < summaries[j].Date })
+
+    writeJSON(w, http.StatusOK, summaries)
+}
+
+func computeStats(values []float64) models.SpeedTestStats {
+    if len(values) == 0 {
+        return models.SpeedTestStats{}
+    }
+    sorted := append([]float64{}, values...)
+    sort.Float64s(sorted)
+
+    sum := 0.0
+    for _, v := range sorted {
+        sum += v
+    }
+    // Nearest-rank percentile.
+    rank := int(math.Ceil(0.95*float64(len(sorted)))) - 1
+
+    return models.SpeedTestStats{
+        Min: sorted[0],
+        Avg: sum / float64(len(sorted)),
+        Max: sorted[len(sorted)-1],
+        P95: sorted[rank],
+    }
+}
@@ -0,0 +1,357 @@
+package handlers
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "io"
+    "math"
+    "net/http"
+    "net/http/httptrace"
+    "net/url"
+    "slices"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "netron/models"
+)
+
+const (
+    DefaultSpeedTestURL = "https://speed.cloudflare.com"
+
+    latencySamples    = 10
+    progressInterval  = 250 * time.Millisecond
+    transferChunkSize = 25 << 20
+    maxStandInBytes   = 1 << 30
+    // At most this many stand-in downloads and uploads run at once, enough
+    // for a few clients with the default four streams.
+    maxStandInTransfers = 16
+)
+
+// standInTransfers holds a token for every running stand-in transfer.
+var standInTransfers = make(chan struct{}, maxStandInTransfers)
+
+// acquireStandIn reserves a stand-in transfer, answering 503 when all are
+// in use. The caller releases it with releaseStandIn.
+func acquireStandIn(w http.ResponseWriter) bool {
+    select {
+    case standInTransfers <- struct{}{}:
+        return true
+    default:
+        w.Header().Set("Retry-After", "10")
+        writeError(w, http.StatusServiceUnavailable, "Too many speed test transfers")
+        return false
+    }
+}
+
+func releaseStandIn() {
+    <-standInTransfers
+}
+
+// NativeSpeedTestConfig configures the built-in HTTP speed test. URL is the
+// base of a server exposing GET /__down?bytes=N and POST /__up, the
+// interface used by speed.cloudflare.com and served by Netron itself under
+// /speedtest. Servers lists further bases a run may pick instead of URL.
+type NativeSpeedTestConfig struct {
+    URL      string
+    Servers  []string
+    Streams  int
+    Duration time.Duration
+}
+
+// nativeBackend is the built-in HTTP speed test. A server passed with the
+// request replaces the configured URL if it is one of the configured
+// servers, so API users cannot make Netron fetch arbitrary URLs.
+type nativeBackend struct {
+    cfg NativeSpeedTestConfig
+}
+
+func newNativeBackend(cfg NativeSpeedTestConfig) (nativeBackend, error) {
+    if _, err := url.ParseRequestURI(cfg.URL); err != nil {
+        return nativeBackend{}, fmt.Errorf("invalid speed test URL: %w", err)
+    }
+    if cfg.Streams < 1 {
+        return nativeBackend{}, errors.New("at least one stream is required")
+    }
+    if cfg.Duration < time.Second {
+        return nativeBackend{}, errors.New("the transfer duration must be at least 1s")
+    }
+    cfg.URL = strings.TrimSuffix(cfg.URL, "/")
+    servers := make([]string, 0, len(cfg.Servers))
+    for _, server := range cfg.Servers {
+        if _, err := url.ParseRequestURI(server); err != nil {
+            return nativeBackend{}, fmt.Errorf("invalid speed test server: %w", err)
+        }
+        servers = append(servers, strings.TrimSuffix(server, "/"))
+    }
+    cfg.Servers = servers
+    return nativeBackend{cfg: cfg}, nil
+}
+
+// allowedServer reports whether a run may use server as its base URL.
+func (b nativeBackend) allowedServer(server string) bool {
+    return server == b.cfg.URL || slices.Contains(b.cfg.Servers, server)
+}
+
+func (b nativeBackend) Run(ctx context.Context, req models.SpeedTestRequest, progress SpeedTestProgress) (models.SpeedTestResult, error) {
+    var result models.SpeedTestResult
+    server := req.Server
+
+    cfg := b.cfg
+    if server != "" {
+        server = strings.TrimSuffix(server, "/")
+        if !b.allowedServer(server) {
+            return result, fmt.Errorf("speed test server %q is not configured", server)
+        }
+        cfg.URL = server
+    }
+    if u, err := url.Parse(cfg.URL); err == nil {
+        result.Server = u.Host
+    }
+
+    client := &http.Client{Timeout: cfg.Duration + 30*time.Second}
+
+    progress(PhasePing, 0, 0)
+    ping, jitter, err := measureLatency(ctx, client, cfg.URL, progress)
+    if err != nil {
+        return result, fmt.Errorf("Latency test failed: %v", err)
+    }
+    result.Ping = ping
+    result.Jitter = jitter
+
+    if result.Download, err = measureThroughput(ctx, cfg, downloadStream, phaseProgress(progress, PhaseDownload, 10, 55)); err != nil {
+        return result, fmt.Errorf("Download test failed: %v", err)
+    }
+    if result.Upload, err = measureThroughput(ctx, cfg, uploadStream, phaseProgress(progress, PhaseUpload, 55, 100)); err != nil {
+        return result, fmt.Errorf("Upload test failed: %v", err)
+    }
+    return result, nil
+}
+
+// measureLatency times empty downloads over a kept-alive connection and
+// returns the median time to first byte and the mean difference between
+// consecutive samples, both in milliseconds.
+func measureLatency(ctx context.Context, client *http.Client, base string, progress SpeedTestProgress) (float64, float64, error) {
+    var samples []float64
+    // The first request pays for DNS, TCP and TLS setup and is discarded.
+    for i := 0; i <= latencySamples; i++ {
+        var sent, firstByte time.Time
+        trace := &httptrace.ClientTrace{
+            WroteRequest:         func(httptrace.WroteRequestInfo) { sent = time.Now() },
+            GotFirstResponseByte: func() { firstByte = time.Now() },
+        }
+        req, err := http.NewRequestWithContext(ctx, "GET", base+"/__down?bytes=0", nil)
+        if err != nil {
+            return 0, 0, err
+        }
+        req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+        resp, err := client.Do(req)
+        if err != nil {
+            return 0, 0, err
+        }
+        io.Copy(io.Discard, resp.Body)
+        resp.Body.Close()
+        if resp.StatusCode != http.StatusOK {
+            return 0, 0, fmt.Errorf("server returned %s", resp.Status)
+        }
+
+        if i > 0 && !sent.IsZero() && firstByte.After(sent) {
+            samples = append(samples, float64(firstByte.Sub(sent))/float64(time.Millisecond))
+        }
+        progress(PhasePing, 10*float64(i)/latencySamples, 0)
+    }
+    if len(samples) == 0 {
+        return 0, 0, errors.New("no latency samples")
+    }
+
+    jitter := 0.0
+    for i := 1; i < len(samples); i++ {
+        jitter += math.Abs(samples[i] - samples[i-1])
+    }
+    if len(samples) > 1 {
+        jitter /= float64(len(samples) - 1)
+    }
+
+    sorted := append([]float64{}, samples...)
+    sort.Float64s(sorted)
+    return sorted[len(sorted)/2], jitter, nil
+}
+
+type streamFunc func(ctx context.Context, client *http.Client, base string, counter *int64) error
+
+// phaseProgress maps the completion of one phase (0 to 1) onto the
+// [from, to] range of the overall progress.
+func phaseProgress(progress SpeedTestProgress, phase string, from, to float64) func(done, mbps float64) {
+    return func(done, mbps float64) {
+        progress(phase, from+(to-from)*done, mbps)
+    }
+}
+
+// measureThroughput runs cfg.Streams copies of stream in parallel for
+// cfg.Duration and returns the combined rate in Mbit/s. The rate over the
+// last sampling period is reported to progress as the test runs.
+func measureThroughput(parent context.Context, cfg NativeSpeedTestConfig, stream streamFunc, progress func(done, mbps float64)) (float64, error) {
+    ctx, cancel := context.WithTimeout(parent, cfg.Duration)
+    defer cancel()
+
+    client := &http.Client{}
+    var transferred int64
+    var wg sync.WaitGroup
+    errs := make(chan error, cfg.Streams)
+
+    start := time.Now()
+    for i := 0; i < cfg.Streams; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for ctx.Err() == nil {
+                if err := stream(ctx, client, cfg.URL, &transferred); err != nil && ctx.Err() == nil {
+                    errs <- err
+                    return
+                }
+            }
+        }()
+    }
+    finished := make(chan struct{})
+    go func() {
+        wg.Wait()
+        close(finished)
+    }()
+
+    ticker := time.NewTicker(progressInterval)
+    defer ticker.Stop()
+    last, lastTime := int64(0), start
+    progress(0, 0)
+    for running := true; running; {
+        select {
+        case now := <-ticker.C:
+            total := atomic.LoadInt64(&transferred)
+            mbps := math.Max(float64(total-last), 0) * 8 / now.Sub(lastTime).Seconds() / 1e6
+            last, lastTime = total, now
+            progress(math.Min(now.Sub(start).Seconds()/cfg.Duration.Seconds(), 1), mbps)
+        case <-finished:
+            running = false
+        }
+    }
+
+    elapsed := time.Since(start).Seconds()
+    if err := parent.Err(); err != nil {
+        return 0, err
+    }
+
+    total := atomic.LoadInt64(&transferred)
+    if total == 0 {
+        select {
+        case err := <-errs:
+            return 0, err
+        default:
+            return 0, errors.New("no data transferred")
+        }
+    }
+    return float64(total) * 8 / elapsed / 1e6, nil
+}
+
+func downloadStream(ctx context.Context, client *http.Client, base string, counter *int64) error {
+    req, err := http.NewRequestWithContext(ctx, "GET", base+"/__down?bytes="+strconv.Itoa(transferChunkSize), nil)
+    if err != nil {
+        return err
+    }
+    resp, err := client.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return fmt.Errorf("server returned %s", resp.Status)
+    }
+
+    _, err = io.Copy(io.Discard, &countingReader{r: resp.Body, n: counter})
+    return err
+}
+
+func uploadStream(ctx context.Context, client *http.Client, base string, counter *int64) error {
+    body := &countingReader{r: io.LimitReader(zeroReader{}, transferChunkSize), n: counter}
+    req, err := http.NewRequestWithContext(ctx, "POST", base+"/__up", body)
+    if err != nil {
+        return err
+    }
+    req.ContentLength = transferChunkSize
+    req.Header.Set("Content-Type", "application/octet-stream")
+
+    resp, err := client.Do(req)
+    if err != nil {
+        return err
+    }
+    io.Copy(io.Discard, resp.Body)
+    resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        // The server did not take the upload, so its bytes do not count.
+        atomic.AddInt64(counter, -atomic.LoadInt64(&body.read))
+        return fmt.Errorf("server returned %s", resp.Status)
+    }
+    return nil
+}
+
+// countingReader adds the bytes read to n, and to read for the bytes of
+// this reader alone.
+type countingReader struct {
+    r    io.Reader
+    n    *int64
+    read int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+    n, err := c.r.Read(p)
+    atomic.AddInt64(c.n, int64(n))
+    atomic.AddInt64(&c.read, int64(n))
+    return n, err
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+    for i := range p {
+        p[i] = 0
+    }
+    return len(p), nil
+}
+
+// SpeedTestDownload serves bytes=N zero bytes, making a Netron instance
+// started with --speedtest-serve usable as the target of another one's
+// native speed test.
+func SpeedTestDownload(w http.ResponseWriter, r *http.Request) {
+    if !acquireStandIn(w) {
+        return
+    }
+    defer releaseStandIn()
+
+    n, err := strconv.ParseInt(r.URL.Query().Get("bytes"), 10, 64)
+    if err != nil || n < 0 {
+        n = 0
+    }
+    if n > maxStandInBytes {
+        n = maxStandInBytes
+    }
+
+    w.Header().Set("Content-Type", "application/octet-stream")
+    w.Header().Set("Cache-Control", "no-store")
+    w.Header().Set("Content-Length", strconv.FormatInt(n, 10))
+    io.CopyN(w, zeroReader{}, n)
+}
+
+// SpeedTestUpload discards the request body.
+func SpeedTestUpload(w http.ResponseWriter, r *http.Request) {
+    if !acquireStandIn(w) {
+        return
+    }
+    defer releaseStandIn()
+
+    io.Copy(io.Discard, io.LimitReader(r.Body, maxStandInBytes))
+    w.Header().Set("Cache-Control", "no-store")
+    w.WriteHeader(http.StatusOK)
+}
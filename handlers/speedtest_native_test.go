@@ -0,0 +1,141 @@
+package handlers
+
+import (
+    "context"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+
+    "netron/models"
+)
+
+// standInServer serves the native speed test interface with the stand-in
+// handlers, letting wrap replace them to inject failures.
+func standInServer(t *testing.T, wrap func(http.ResponseWriter, *http.Request, http.HandlerFunc)) *httptest.Server {
+    t.Helper()
+    mux := http.NewServeMux()
+    for path, handler := range map[string]http.HandlerFunc{
+        "/__down": SpeedTestDownload,
+        "/__up":   SpeedTestUpload,
+    } {
+        handler := handler
+        mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+            if wrap == nil {
+                handler(w, r)
+                return
+            }
+            wrap(w, r, handler)
+        })
+    }
+    srv := httptest.NewServer(mux)
+    t.Cleanup(srv.Close)
+    return srv
+}
+
+func testNativeBackend(t *testing.T, url string, duration time.Duration) nativeBackend {
+    t.Helper()
+    b, err := newNativeBackend(NativeSpeedTestConfig{URL: url, Streams: 2, Duration: duration})
+    if err != nil {
+        t.Fatal(err)
+    }
+    return b
+}
+
+func noProgress(string, float64, float64) {}
+
+func TestNativeSpeedTest(t *testing.T) {
+    srv := standInServer(t, nil)
+    b := testNativeBackend(t, srv.URL, time.Second)
+
+    var phases []string
+    progress := func(phase string, percent, mbps float64) {
+        if len(phases) == 0 || phases[len(phases)-1] != phase {
+            phases = append(phases, phase)
+        }
+    }
+    result, err := b.Run(context.Background(), models.SpeedTestRequest{}, progress)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if result.Ping <= 0 || result.Download <= 0 || result.Upload <= 0 {
+        t.Errorf("got ping %v ms, download %v and upload %v Mbit/s, want all above zero", result.Ping, result.Download, result.Upload)
+    }
+    if want := strings.TrimPrefix(srv.URL, "http://"); result.Server != want {
+        t.Errorf("server %q, want %q", result.Server, want)
+    }
+    if want := []string{PhasePing, PhaseDownload, PhaseUpload}; strings.Join(phases, ",") != strings.Join(want, ",") {
+        t.Errorf("phases %v, want %v", phases, want)
+    }
+}
+
+func TestNativeSpeedTestErrors(t *testing.T) {
+    tests := []struct {
+        name string
+        fail func(r *http.Request) bool
+        want string
+    }{
+        {"latency", func(r *http.Request) bool { return true }, "Latency test failed: server returned 500"},
+        {"download", func(r *http.Request) bool {
+            return r.URL.Path == "/__down" && r.URL.Query().Get("bytes") != "0"
+        }, "Download test failed: server returned 500"},
+        {"upload", func(r *http.Request) bool { return r.URL.Path == "/__up" }, "Upload test failed: server returned 500"},
+    }
+    for _, tt := range tests {
+        srv := standInServer(t, func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+            if tt.fail(r) {
+                http.Error(w, "failed", http.StatusInternalServerError)
+                return
+            }
+            next(w, r)
+        })
+        b := testNativeBackend(t, srv.URL, time.Second)
+        _, err := b.Run(context.Background(), models.SpeedTestRequest{}, noProgress)
+        if err == nil || !strings.Contains(err.Error(), tt.want) {
+            t.Errorf("%s: got error %v, want %q", tt.name, err, tt.want)
+        }
+    }
+}
+
+func TestNativeSpeedTestCancel(t *testing.T) {
+    srv := standInServer(t, nil)
+    b := testNativeBackend(t, srv.URL, 10*time.Second)
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    progress := func(phase string, percent, mbps float64) {
+        if phase == PhaseDownload && mbps > 0 {
+            cancel()
+        }
+    }
+    start := time.Now()
+    _, err := b.Run(ctx, models.SpeedTestRequest{}, progress)
+    if err == nil || !strings.Contains(err.Error(), context.Canceled.Error()) {
+        t.Errorf("got error %v, want %v", err, context.Canceled)
+    }
+    if elapsed := time.Since(start); elapsed > 5*time.Second {
+        t.Errorf("cancelled run took %s", elapsed)
+    }
+}
+
+func TestNativeSpeedTestServer(t *testing.T) {
+    srv := standInServer(t, nil)
+    b, err := newNativeBackend(NativeSpeedTestConfig{
+        URL:      "http://192.0.2.1/speedtest",
+        Servers:  []string{srv.URL + "/"},
+        Streams:  1,
+        Duration: time.Second,
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if _, err := b.Run(context.Background(), models.SpeedTestRequest{Server: srv.URL}, noProgress); err != nil {
+        t.Errorf("configured server: %v", err)
+    }
+    _, err = b.Run(context.Background(), models.SpeedTestRequest{Server: "http://169.254.169.254"}, noProgress)
+    if err == nil || !strings.Contains(err.Error(), "not configured") {
+        t.Errorf("unlisted server: got error %v", err)
+    }
+}
@@ -0,0 +1,898 @@
+package handlers
+
+import (
+    "bufio"
+    "context"
+    "crypto/rand"
+    "crypto/subtle"
+    "encoding/binary"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "math"
+    "net"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "golang.org/x/sys/unix"
+
+    "netron/models"
+)
+
+// The peer backend measures raw TCP or UDP throughput between two Netron
+// instances, in the spirit of iperf3. One instance runs the peer server
+// (--peer-port) and the other connects to it as a speed test backend.
+//
+// Each test direction uses a TCP control connection carrying one JSON
+// request, an acknowledgement with the session token chosen by the server
+// and one JSON report. TCP payload flows over a second connection
+// to the same port that announces itself with a data header; UDP payload
+// is sent to the same port number over UDP. Every datagram starts with
+// the session token, a sequence number, the sender's clock and the time
+// the stream started, so the receiver can count loss per interval and
+// compute jitter.
+//
+// The server runs one test at a time, only takes data from the address of
+// the control connection and caps the UDP rate, so the port cannot be used
+// to flood third parties.
+const (
+    BackendPeer = "peer"
+
+    DefaultPeerPort         = 5301
+    DefaultPeerMaxBandwidth = 1000 // Mbit/s
+
+    peerDataHeader     = "NETRONDATA "
+    peerIntervalLength = time.Second
+    peerMaxDuration    = 60
+    peerDefaultUDPRate = 10 // Mbit/s
+    peerPacketSize     = 1400
+    peerHeaderSize     = 32
+    peerTokenSize      = 8
+    peerMaxPacketRate  = 100000 // datagrams per second
+)
+
+type peerRequest struct {
+    Secret     string  `json:"secret,omitempty"`
+    Token      string  `json:"-"`
+    Protocol   string  `json:"protocol"`
+    Direction  string  `json:"direction"`
+    Duration   int     `json:"duration"`
+    Bandwidth  float64 `json:"bandwidth"`
+    PacketSize int     `json:"packet_size"`
+}
+
+type peerInterval struct {
+    Bytes       uint64  `json:"bytes"`
+    Packets     int     `json:"packets,omitempty"`
+    Retransmits int     `json:"retransmits,omitempty"`
+    Jitter      float64 `json:"jitter,omitempty"`
+}
+
+type peerReport struct {
+    Error     string         `json:"error,omitempty"`
+    Token     string         `json:"token,omitempty"`
+    Intervals []peerInterval `json:"intervals,omitempty"`
+}
+
+// peerSession is a test in progress on the server side, found by token
+// when its data connection or datagrams arrive. Only those coming from
+// clientIP, the address of the control connection, are accepted.
+type peerSession struct {
+    req      peerRequest
+    clientIP net.IP
+    data     chan net.Conn
+    packets  chan peerPacket
+}
+
+type peerPacket struct {
+    payload  []byte
+    addr     *net.UDPAddr
+    received time.Time
+}
+
+// peerDataConn keeps the bytes the server buffered while reading the data
+// header.
+type peerDataConn struct {
+    *net.TCPConn
+    reader *bufio.Reader
+}
+
+func (c *peerDataConn) Read(p []byte) (int, error) {
+    return c.reader.Read(p)
+}
+
+func asTCPConn(conn net.Conn) *net.TCPConn {
+    switch c := conn.(type) {
+    case *net.TCPConn:
+        return c
+    case *peerDataConn:
+        return c.TCPConn
+    }
+    return nil
+}
+
+// PeerServerConfig configures the peer server. Clients must send Secret
+// when it is set, and UDP tests are limited to MaxBandwidth Mbit/s.
+type PeerServerConfig struct {
+    Port         int
+    Secret       string
+    MaxBandwidth float64
+}
+
+var peerSessions = struct {
+    sync.Mutex
+    byToken map[string]*peerSession
+}{byToken: make(map[string]*peerSession)}
+
+var (
+    peerSecret       string
+    peerMaxBandwidth float64
+    // peerBusy admits one test at a time.
+    peerBusy sync.Mutex
+)
+
+// StartPeerServer accepts throughput tests from other Netron instances on
+// the configured port, over both TCP and UDP.
+func StartPeerServer(cfg PeerServerConfig) error {
+    if cfg.MaxBandwidth <= 0 {
+        return errors.New("the peer bandwidth limit must be positive")
+    }
+    peerSecret, peerMaxBandwidth = cfg.Secret, cfg.MaxBandwidth
+
+    addr := ":" + strconv.Itoa(cfg.Port)
+    tcp, err := net.Listen("tcp", addr)
+    if err != nil {
+        return err
+    }
+    udp, err := net.ListenPacket("udp", addr)
+    if err != nil {
+        tcp.Close()
+        return err
+    }
+
+    go func() {
+        for {
+            conn, err := tcp.Accept()
+            if err != nil {
+                log.Printf("peer server: %v", err)
+                return
+            }
+            go handlePeerConn(conn, udp.(*net.UDPConn))
+        }
+    }()
+    go readPeerPackets(udp.(*net.UDPConn))
+    return nil
+}
+
+func handlePeerConn(conn net.Conn, udp *net.UDPConn) {
+    conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+    reader := bufio.NewReader(conn)
+    line, err := reader.ReadString('\n')
+    if err != nil {
+        conn.Close()
+        return
+    }
+    conn.SetReadDeadline(time.Time{})
+
+    if token, ok := strings.CutPrefix(line, peerDataHeader); ok {
+        peerSessions.Lock()
+        session := peerSessions.byToken[strings.TrimSpace(token)]
+        peerSessions.Unlock()
+        tcp, isTCP := conn.(*net.TCPConn)
+        if session == nil || !isTCP || !tcp.RemoteAddr().(*net.TCPAddr).IP.Equal(session.clientIP) {
+            conn.Close()
+            return
+        }
+        select {
+        case session.data <- &peerDataConn{TCPConn: tcp, reader: reader}:
+        default:
+            conn.Close()
+        }
+        return
+    }
+
+    defer conn.Close()
+    encoder := json.NewEncoder(conn)
+
+    var req peerRequest
+    if err := json.Unmarshal([]byte(line), &req); err != nil {
+        encoder.Encode(peerReport{Error: "invalid request"})
+        return
+    }
+    if peerSecret != "" && subtle.ConstantTimeCompare([]byte(req.Secret), []byte(peerSecret)) != 1 {
+        log.Printf("peer server: rejected %s: invalid secret", conn.RemoteAddr())
+        encoder.Encode(peerReport{Error: "invalid secret"})
+        return
+    }
+    if err := validatePeerRequest(&req); err != nil {
+        encoder.Encode(peerReport{Error: err.Error()})
+        return
+    }
+    if !peerBusy.TryLock() {
+        encoder.Encode(peerReport{Error: "another test is running"})
+        return
+    }
+    defer peerBusy.Unlock()
+
+    token := make([]byte, peerTokenSize)
+    if _, err := rand.Read(token); err != nil {
+        encoder.Encode(peerReport{Error: err.Error()})
+        return
+    }
+    req.Token = hex.EncodeToString(token)
+    session := &peerSession{
+        req:      req,
+        clientIP: conn.RemoteAddr().(*net.TCPAddr).IP,
+        data:     make(chan net.Conn, 1),
+        packets:  make(chan peerPacket, 1024),
+    }
+    peerSessions.Lock()
+    if _, taken := peerSessions.byToken[req.Token]; taken {
+        peerSessions.Unlock()
+        encoder.Encode(peerReport{Error: "token already in use"})
+        return
+    }
+    peerSessions.byToken[req.Token] = session
+    peerSessions.Unlock()
+    defer func() {
+        peerSessions.Lock()
+        delete(peerSessions.byToken, req.Token)
+        peerSessions.Unlock()
+    }()
+
+    if err := encoder.Encode(peerReport{Token: req.Token}); err != nil {
+        return
+    }
+
+    var intervals []peerInterval
+    switch {
+    case req.Protocol == "tcp" && req.Direction == "upload":
+        intervals, err = serveTCPUpload(session)
+    case req.Protocol == "tcp":
+        intervals, err = serveTCPDownload(session)
+    case req.Direction == "upload":
+        intervals, err = serveUDPUpload(session, reader)
+    default:
+        intervals, err = serveUDPDownload(session, udp)
+    }
+    if err != nil {
+        encoder.Encode(peerReport{Error: err.Error()})
+        return
+    }
+    encoder.Encode(peerReport{Intervals: intervals})
+}
+
+func validatePeerRequest(req *peerRequest) error {
+    if req.Protocol != "tcp" && req.Protocol != "udp" {
+        return fmt.Errorf("unsupported protocol %q", req.Protocol)
+    }
+    if req.Direction != "upload" && req.Direction != "download" {
+        return fmt.Errorf("unsupported direction %q", req.Direction)
+    }
+    if req.Duration < 1 || req.Duration > peerMaxDuration {
+        return fmt.Errorf("duration must be between 1 and %d seconds", peerMaxDuration)
+    }
+    if req.Protocol == "udp" {
+        if req.Bandwidth <= 0 {
+            return errors.New("udp tests need a bandwidth")
+        }
+        if req.PacketSize < peerHeaderSize || req.PacketSize > 65000 {
+            return errors.New("invalid packet size")
+        }
+        if req.Bandwidth > peerMaxBandwidth {
+            return fmt.Errorf("bandwidth is limited to %g Mbit/s", peerMaxBandwidth)
+        }
+        if req.Bandwidth*1e6/8/float64(req.PacketSize) > peerMaxPacketRate {
+            return fmt.Errorf("packet rate is limited to %d per second", peerMaxPacketRate)
+        }
+    }
+    return nil
+}
+
+func waitPeerData(session *peerSession) (net.Conn, error) {
+    select {
+    case conn := <-session.data:
+        return conn, nil
+    case <-time.After(10 * time.Second):
+        return nil, errors.New("data connection never arrived")
+    }
+}
+
+func serveTCPUpload(session *peerSession) ([]peerInterval, error) {
+    conn, err := waitPeerData(session)
+    if err != nil {
+        return nil, err
+    }
+    defer conn.Close()
+
+    duration := time.Duration(session.req.Duration) * time.Second
+    conn.SetReadDeadline(time.Now().Add(duration + 10*time.Second))
+    return receiveTCP(conn, session.req.Duration, nil)
+}
+
+func serveTCPDownload(session *peerSession) ([]peerInterval, error) {
+    conn, err := waitPeerData(session)
+    if err != nil {
+        return nil, err
+    }
+    defer conn.Close()
+    return sendTCP(context.Background(), conn, session.req.Duration, nil)
+}
+
+// sendTCP writes to conn for duration seconds and reports bytes written and
+// retransmitted segments per interval. A non-nil counter is kept up to date
+// with the bytes written so far.
+func sendTCP(ctx context.Context, conn net.Conn, duration int, counter *int64) ([]peerInterval, error) {
+    intervals := make([]peerInterval, duration)
+    buf := make([]byte, 128<<10)
+    start := time.Now()
+    end := start.Add(time.Duration(duration) * time.Second)
+    conn.SetWriteDeadline(end.Add(5 * time.Second))
+
+    lastRetrans := tcpRetransmits(conn)
+    current := 0
+    for {
+        now := time.Now()
+        if !now.Before(end) || ctx.Err() != nil {
+            break
+        }
+        if i := int(now.Sub(start) / peerIntervalLength); i != current {
+            retrans := tcpRetransmits(conn)
+            intervals[current].Retransmits = retrans - lastRetrans
+            lastRetrans, current = retrans, i
+        }
+
+        n, err := conn.Write(buf)
+        intervals[current].Bytes += uint64(n)
+        addCount(counter, n)
+        if err != nil {
+            return nil, err
+        }
+    }
+    intervals[current].Retransmits = tcpRetransmits(conn) - lastRetrans
+
+    if tcp := asTCPConn(conn); tcp != nil {
+        tcp.CloseWrite()
+    }
+    return intervals, ctx.Err()
+}
+
+// receiveTCP reads conn until EOF and reports bytes received per interval,
+// counted from the first byte.
+func receiveTCP(conn net.Conn, duration int, counter *int64) ([]peerInterval, error) {
+    intervals := make([]peerInterval, duration)
+    buf := make([]byte, 128<<10)
+    var start time.Time
+
+    for {
+        n, err := conn.Read(buf)
+        if n > 0 {
+            now := time.Now()
+            if start.IsZero() {
+                start = now
+            }
+            i := int(now.Sub(start) / peerIntervalLength)
+            if i >= duration {
+                i = duration - 1
+            }
+            intervals[i].Bytes += uint64(n)
+            addCount(counter, n)
+        }
+        if err == io.EOF {
+            return intervals, nil
+        }
+        if err != nil {
+            return nil, err
+        }
+    }
+}
+
+func addCount(counter *int64, n int) {
+    if counter != nil {
+        atomic.AddInt64(counter, int64(n))
+    }
+}
+
+// trackPeerProgress reports the rate at which counter grows until the
+// returned stop function is called.
+func trackPeerProgress(counter *int64, duration int, progress func(done, mbps float64)) func() {
+    done := make(chan struct{})
+    go func() {
+        ticker := time.NewTicker(progressInterval)
+        defer ticker.Stop()
+        start := time.Now()
+        last, lastTime := int64(0), start
+        progress(0, 0)
+        for {
+            select {
+            case now := <-ticker.C:
+                total := atomic.LoadInt64(counter)
+                mbps := float64(total-last) * 8 / now.Sub(lastTime).Seconds() / 1e6
+                last, lastTime = total, now
+                progress(math.Min(now.Sub(start).Seconds()/float64(duration), 1), mbps)
+            case <-done:
+                return
+            }
+        }
+    }()
+    return func() { close(done) }
+}
+
+func tcpRetransmits(conn net.Conn) int {
+    tcp := asTCPConn(conn)
+    if tcp == nil {
+        return 0
+    }
+    raw, err := tcp.SyscallConn()
+    if err != nil {
+        return 0
+    }
+
+    var retrans int
+    raw.Control(func(fd uintptr) {
+        if info, err := unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO); err == nil {
+            retrans = int(info.Total_retrans)
+        }
+    })
+    return retrans
+}
+
+// readPeerPackets dispatches datagrams arriving on the peer port to their
+// session.
+func readPeerPackets(udp *net.UDPConn) {
+    buf := make([]byte, 65536)
+    for {
+        n, addr, err := udp.ReadFromUDP(buf)
+        if err != nil {
+            log.Printf("peer server: %v", err)
+            return
+        }
+        if n < peerHeaderSize {
+            continue
+        }
+
+        token := hex.EncodeToString(buf[:peerTokenSize])
+        peerSessions.Lock()
+        session := peerSessions.byToken[token]
+        peerSessions.Unlock()
+        if session == nil || !addr.IP.Equal(session.clientIP) {
+            continue
+        }
+
+        packet := peerPacket{
+            payload:  append([]byte{}, buf[:peerHeaderSize]...),
+            addr:     addr,
+            received: time.Now(),
+        }
+        select {
+        case session.packets <- packet:
+        default:
+            // The session is not keeping up; count it as lost.
+        }
+    }
+}
+
+// udpReceiver accumulates per-interval statistics for a UDP stream. Packets
+// are assigned to intervals by their send time relative to the sender's
+// start, so the receiver's counts line up with the sender's.
+type udpReceiver struct {
+    intervals []peerInterval
+    counter   *int64
+    transit   float64
+    jitter    float64
+    started   bool
+}
+
+func newUDPReceiver(duration int) *udpReceiver {
+    return &udpReceiver{intervals: make([]peerInterval, duration)}
+}
+
+func (u *udpReceiver) add(payload []byte, received time.Time, size int) {
+    sent := int64(binary.BigEndian.Uint64(payload[16:24]))
+    start := int64(binary.BigEndian.Uint64(payload[24:32]))
+    // The first datagram of a stream has sequence number 1; 0 is reserved
+    // for the download hello.
+    if binary.BigEndian.Uint64(payload[8:16]) == 0 {
+        return
+    }
+    u.started = true
+
+    // RFC 3550 interarrival jitter; only transit time differences matter,
+    // so the two clocks need not be synchronised.
+    transit := float64(received.UnixNano() - sent)
+    if u.transit != 0 {
+        d := transit - u.transit
+        if d < 0 {
+            d = -d
+        }
+        u.jitter += (d - u.jitter) / 16
+    }
+    u.transit = transit
+
+    i := int(time.Duration(sent-start) / peerIntervalLength)
+    if i < 0 {
+        i = 0
+    }
+    if i >= len(u.intervals) {
+        i = len(u.intervals) - 1
+    }
+    u.intervals[i].Packets++
+    u.intervals[i].Bytes += uint64(size)
+    addCount(u.counter, size)
+    u.intervals[i].Jitter = u.jitter / float64(time.Millisecond)
+}
+
+func serveUDPUpload(session *peerSession, control *bufio.Reader) ([]peerInterval, error) {
+    receiver := newUDPReceiver(session.req.Duration)
+
+    // The client writes a line on the control connection once it has sent
+    // its last datagram.
+    done := make(chan error, 1)
+    go func() {
+        _, err := control.ReadString('\n')
+        done <- err
+    }()
+
+    timeout := time.After(time.Duration(session.req.Duration)*time.Second + 15*time.Second)
+    for {
+        select {
+        case packet := <-session.packets:
+            receiver.add(packet.payload, packet.received, session.req.PacketSize)
+        case err := <-done:
+            if err != nil {
+                return nil, err
+            }
+            // Give datagrams still in flight a moment to land.
+            drain := time.After(500 * time.Millisecond)
+            for {
+                select {
+                case packet := <-session.packets:
+                    receiver.add(packet.payload, packet.received, session.req.PacketSize)
+                case <-drain:
+                    return receiver.intervals, nil
+                }
+            }
+        case <-timeout:
+            return nil, errors.New("timed out waiting for the client")
+        }
+    }
+}
+
+func serveUDPDownload(session *peerSession, udp *net.UDPConn) ([]peerInterval, error) {
+    var addr *net.UDPAddr
+    select {
+    case packet := <-session.packets:
+        addr = packet.addr
+    case <-time.After(10 * time.Second):
+        return nil, errors.New("client hello never arrived")
+    }
+
+    token, _ := hex.DecodeString(session.req.Token)
+    return sendUDP(context.Background(), func(p []byte) error {
+        _, err := udp.WriteToUDP(p, addr)
+        return err
+    }, token, session.req, nil)
+}
+
+// sendUDP paces datagrams at req.Bandwidth Mbit/s for req.Duration seconds
+// and reports how many it sent per interval.
+func sendUDP(ctx context.Context, send func([]byte) error, token []byte, req peerRequest, counter *int64) ([]peerInterval, error) {
+    intervals := make([]peerInterval, req.Duration)
+    packet := make([]byte, req.PacketSize)
+    copy(packet, token)
+
+    perSecond := req.Bandwidth * 1e6 / 8 / float64(req.PacketSize)
+    duration := time.Duration(req.Duration) * time.Second
+    start := time.Now()
+    binary.BigEndian.PutUint64(packet[24:], uint64(start.UnixNano()))
+    var seq uint64
+
+    for ctx.Err() == nil {
+        elapsed := time.Since(start)
+        if elapsed >= duration {
+            break
+        }
+        due := uint64(elapsed.Seconds() * perSecond)
+        if seq >= due {
+            time.Sleep(time.Millisecond)
+            continue
+        }
+        for seq < due {
+            seq++
+            now := time.Now()
+            binary.BigEndian.PutUint64(packet[8:], seq)
+            binary.BigEndian.PutUint64(packet[16:], uint64(now.UnixNano()))
+            if err := send(packet); err != nil {
+                // Transient buffer exhaustion is loss, not failure.
+                if errors.Is(err, unix.ENOBUFS) {
+                    continue
+                }
+                return nil, err
+            }
+            i := int(now.Sub(start) / peerIntervalLength)
+            if i >= len(intervals) {
+                i = len(intervals) - 1
+            }
+            intervals[i].Packets++
+            intervals[i].Bytes += uint64(len(packet))
+            addCount(counter, len(packet))
+        }
+    }
+    return intervals, ctx.Err()
+}
+
+// peerBackend is the client side of a peer test. req.Server is host:port
+// and defaults to the configured --peer-server.
+type peerBackend struct {
+    server string
+    secret string
+}
+
+func (b peerBackend) Run(ctx context.Context, req models.SpeedTestRequest, progress SpeedTestProgress) (models.SpeedTestResult, error) {
+    var result models.SpeedTestResult
+
+    server := req.Server
+    if server == "" {
+        server = b.server
+    }
+    if server == "" {
+        return result, errors.New("no peer server configured")
+    }
+    if _, _, err := net.SplitHostPort(server); err != nil {
+        server = net.JoinHostPort(server, strconv.Itoa(DefaultPeerPort))
+    }
+    result.Server = server
+
+    pr := peerRequest{
+        Secret:     b.secret,
+        Protocol:   strings.ToLower(req.Protocol),
+        Duration:   req.Duration,
+        Bandwidth:  req.Bandwidth,
+        PacketSize: peerPacketSize,
+    }
+    if pr.Protocol == "" {
+        pr.Protocol = "tcp"
+    }
+    if pr.Duration == 0 {
+        pr.Duration = 10
+    }
+    if pr.Protocol == "udp" && pr.Bandwidth == 0 {
+        pr.Bandwidth = peerDefaultUDPRate
+    }
+    result.Protocol = pr.Protocol
+
+    var sent, lost int
+    var jitters []float64
+    phases := []struct {
+        direction, phase string
+        from, to         float64
+    }{
+        {"upload", PhaseUpload, 0, 50},
+        {"download", PhaseDownload, 50, 100},
+    }
+    for _, p := range phases {
+        direction := p.direction
+        pr.Direction = direction
+        intervals, rtt, err := runPeerDirection(ctx, server, pr, phaseProgress(progress, p.phase, p.from, p.to))
+        if err != nil {
+            return result, fmt.Errorf("Peer %s test failed: %v", direction, err)
+        }
+        if direction == "upload" {
+            result.Ping = rtt
+        }
+
+        var bytes uint64
+        for _, interval := range intervals {
+            bytes += interval.Bytes
+            result.Retransmits += interval.Retransmits
+            sent += interval.Packets + interval.Lost
+            lost += interval.Lost
+            if pr.Protocol == "udp" {
+                jitters = append(jitters, interval.Jitter)
+            }
+        }
+        mbps := float64(bytes) * 8 / float64(pr.Duration) / 1e6
+        if direction == "upload" {
+            result.Upload = mbps
+        } else {
+            result.Download = mbps
+        }
+        result.Intervals = append(result.Intervals, intervals...)
+    }
+
+    if sent > 0 {
+        result.Loss = float64(lost) / float64(sent) * 100
+    }
+    if len(jitters) > 0 {
+        sum := 0.0
+        for _, j := range jitters {
+            sum += j
+        }
+        result.Jitter = sum / float64(len(jitters))
+    }
+    return result, nil
+}
+
+// runPeerDirection runs one direction of a peer test and returns its
+// intervals along with the control connection's connect time in ms.
+func runPeerDirection(ctx context.Context, server string, pr peerRequest, progress func(done, mbps float64)) ([]models.SpeedTestInterval, float64, error) {
+    dialer := &net.Dialer{Timeout: 10 * time.Second}
+    dialStart := time.Now()
+    control, err := dialer.DialContext(ctx, "tcp", server)
+    if err != nil {
+        return nil, 0, err
+    }
+    rtt := float64(time.Since(dialStart)) / float64(time.Millisecond)
+    defer control.Close()
+
+    // Unblock reads on the control connection if the test is cancelled.
+    stop := context.AfterFunc(ctx, func() { control.Close() })
+    defer stop()
+
+    reader := bufio.NewReader(control)
+    if err := json.NewEncoder(control).Encode(pr); err != nil {
+        return nil, 0, err
+    }
+    var ack peerReport
+    if err := readPeerReport(reader, &ack); err != nil {
+        return nil, 0, err
+    }
+    token, err := hex.DecodeString(ack.Token)
+    if err != nil || len(token) != peerTokenSize {
+        return nil, 0, errors.New("the peer sent no valid session token")
+    }
+    pr.Token = ack.Token
+
+    var transferred int64
+    stopProgress := trackPeerProgress(&transferred, pr.Duration, progress)
+    var local []peerInterval
+    switch pr.Protocol {
+    case "tcp":
+        local, err = runTCPData(ctx, dialer, server, pr, &transferred)
+    case "udp":
+        local, err = runUDPData(ctx, server, token, pr, control, &transferred)
+    }
+    stopProgress()
+    if err != nil {
+        return nil, 0, err
+    }
+
+    var report peerReport
+    if err := readPeerReport(reader, &report); err != nil {
+        return nil, 0, err
+    }
+    return mergePeerIntervals(pr, local, report.Intervals), rtt, nil
+}
+
+func readPeerReport(reader *bufio.Reader, report *peerReport) error {
+    line, err := reader.ReadBytes('\n')
+    if err != nil {
+        return err
+    }
+    if err := json.Unmarshal(line, report); err != nil {
+        return err
+    }
+    if report.Error != "" {
+        return errors.New(report.Error)
+    }
+    return nil
+}
+
+func runTCPData(ctx context.Context, dialer *net.Dialer, server string, pr peerRequest, counter *int64) ([]peerInterval, error) {
+    conn, err := dialer.DialContext(ctx, "tcp", server)
+    if err != nil {
+        return nil, err
+    }
+    defer conn.Close()
+    stop := context.AfterFunc(ctx, func() { conn.Close() })
+    defer stop()
+
+    if _, err := io.WriteString(conn, peerDataHeader+pr.Token+"\n"); err != nil {
+        return nil, err
+    }
+    if pr.Direction == "upload" {
+        return sendTCP(ctx, conn, pr.Duration, counter)
+    }
+    conn.SetReadDeadline(time.Now().Add(time.Duration(pr.Duration)*time.Second + 10*time.Second))
+    return receiveTCP(conn, pr.Duration, counter)
+}
+
+func runUDPData(ctx context.Context, server string, token []byte, pr peerRequest, control net.Conn, counter *int64) ([]peerInterval, error) {
+    conn, err := net.Dial("udp", server)
+    if err != nil {
+        return nil, err
+    }
+    defer conn.Close()
+
+    if pr.Direction == "upload" {
+        intervals, err := sendUDP(ctx, func(p []byte) error {
+            _, err := conn.Write(p)
+            return err
+        }, token, pr, counter)
+        if err != nil {
+            return nil, err
+        }
+        if _, err := io.WriteString(control, "{\"done\":true}\n"); err != nil {
+            return nil, err
+        }
+        return intervals, nil
+    }
+
+    // Announce our address with sequence 0 hellos until data flows.
+    hello := make([]byte, peerHeaderSize)
+    copy(hello, token)
+    receiver := newUDPReceiver(pr.Duration)
+    receiver.counter = counter
+    buf := make([]byte, 65536)
+    deadline := time.Now().Add(time.Duration(pr.Duration)*time.Second + 10*time.Second)
+
+    for time.Now().Before(deadline) && ctx.Err() == nil {
+        if !receiver.started {
+            conn.Write(hello)
+            conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+        } else {
+            conn.SetReadDeadline(time.Now().Add(time.Second))
+        }
+        n, err := conn.Read(buf)
+        if err != nil {
+            var netErr net.Error
+            if errors.As(err, &netErr) && netErr.Timeout() {
+                if receiver.started {
+                    // A second of silence after data flowed: the sender is done.
+                    break
+                }
+                continue
+            }
+            return nil, err
+        }
+        if n >= peerHeaderSize && string(buf[:peerTokenSize]) == string(token) {
+            receiver.add(buf[:peerHeaderSize], time.Now(), n)
+        }
+    }
+    return receiver.intervals, ctx.Err()
+}
+
+// mergePeerIntervals combines the client's and the server's view of each
+// interval: bytes come from the receiving side, retransmits from the
+// sending side, and UDP loss from comparing the two.
+func mergePeerIntervals(pr peerRequest, local, remote []peerInterval) []models.SpeedTestInterval {
+    sender, receiver := local, remote
+    if pr.Direction == "download" {
+        sender, receiver = remote, local
+    }
+
+    intervals := make([]models.SpeedTestInterval, pr.Duration)
+    for i := range intervals {
+        var snd, rcv peerInterval
+        if i < len(sender) {
+            snd = sender[i]
+        }
+        if i < len(receiver) {
+            rcv = receiver[i]
+        }
+
+        interval := models.SpeedTestInterval{
+            Direction:   pr.Direction,
+            Start:       float64(i),
+            End:         float64(i + 1),
+            Bytes:       rcv.Bytes,
+            Bandwidth:   float64(rcv.Bytes) * 8 / peerIntervalLength.Seconds() / 1e6,
+            Retransmits: snd.Retransmits,
+        }
+        if pr.Protocol == "udp" {
+            interval.Packets = rcv.Packets
+            interval.Jitter = rcv.Jitter
+            if snd.Packets > rcv.Packets {
+                interval.Lost = snd.Packets - rcv.Packets
+            }
+        }
+        intervals[i] = interval
+    }
+    return intervals
+}
@@ -0,0 +1,144 @@
+package handlers
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "time"
+
+    "netron/models"
+)
+
+const (
+    PhaseStarting        = "starting"
+    PhaseSelectingServer = "selecting_server"
+    PhasePing            = "ping"
+    PhaseDownload        = "download"
+    PhaseUpload          = "upload"
+    PhaseComplete        = "complete"
+    PhaseFailed          = "failed"
+    PhaseCancelled       = "cancelled"
+    PhaseTimeout         = "timeout"
+
+    maxProgressSamples = 600
+)
+
+// SpeedTestProgress is how a backend reports what it is doing: the current
+// phase, overall completion in percent and, during transfers, the current
+// throughput in Mbit/s.
+type SpeedTestProgress func(phase string, percent, mbps float64)
+
+var (
+    progressStarted time.Time
+    subscribers     = make(map[chan models.SpeedTestInfo]struct{})
+)
+
+// resetProgress clears the progress of the previous run. The caller must
+// hold speedTestMutex.
+func resetProgress() {
+    progressStarted = time.Now()
+    currentTest.Phase = PhaseStarting
+    currentTest.Progress = 0
+    currentTest.CurrentSpeed = 0
+    currentTest.Samples = nil
+}
+
+func reportProgress(phase string, percent, mbps float64) {
+    speedTestMutex.Lock()
+    defer speedTestMutex.Unlock()
+
+    if !isRunning {
+        return
+    }
+    currentTest.Phase = phase
+    if percent > currentTest.Progress {
+        currentTest.Progress = percent
+    }
+    currentTest.CurrentSpeed = mbps
+
+    if mbps > 0 {
+        sample := models.SpeedTestSample{
+            Phase:   phase,
+            Elapsed: time.Since(progressStarted).Seconds(),
+            Speed:   mbps,
+        }
+        // Readers may hold a copy of the slice header, so samples are never
+        // modified in place.
+        samples := currentTest.Samples
+        if len(samples) >= maxProgressSamples {
+            samples = append([]models.SpeedTestSample{}, samples[1:]...)
+        }
+        currentTest.Samples = append(samples, sample)
+    }
+    publishSpeedTest()
+}
+
+// publishSpeedTest sends the current state to every stream subscriber.
+// The caller must hold speedTestMutex.
+func publishSpeedTest() {
+    for ch := range subscribers {
+        select {
+        case ch <- currentTest:
+        default:
+            // A slow client misses an update; the next one supersedes it.
+        }
+    }
+}
+
+// StreamSpeedTest sends the speed test state as server-sent events
+// whenever it changes.
+func StreamSpeedTest(w http.ResponseWriter, r *http.Request) {
+    flusher, ok := w.(http.Flusher)
+    if !ok {
+        writeError(w, http.StatusInternalServerError, "Streaming unsupported")
+        return
+    }
+
+    ch := make(chan models.SpeedTestInfo, 16)
+    speedTestMutex.Lock()
+    subscribers[ch] = struct{}{}
+    initial := currentTest
+    speedTestMutex.Unlock()
+    defer func() {
+        speedTestMutex.Lock()
+        delete(subscribers, ch)
+        speedTestMutex.Unlock()
+    }()
+
+    w.Header().Set("Content-Type", "text/event-stream")
+    w.Header().Set("Cache-Control", "no-cache")
+    w.Header().Set("Connection", "keep-alive")
+
+    send := func(info models.SpeedTestInfo) bool {
+        data, err := json.Marshal(info)
+        if err != nil {
+            return false
+        }
+        if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+            return false
+        }
+        flusher.Flush()
+        return true
+    }
+    if !send(initial) {
+        return
+    }
+
+    heartbeat := time.NewTicker(15 * time.Second)
+    defer heartbeat.Stop()
+    for {
+        select {
+        case info := <-ch:
+            if !send(info) {
+                return
+            }
+        case <-heartbeat.C:
+            if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+                return
+            }
+            flusher.Flush()
+        case <-r.Context().Done():
+            return
+        }
+    }
+}
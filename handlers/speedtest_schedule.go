@@ -0,0 +1,254 @@
+package handlers
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "math/rand"
+    "net/http"
+    "strings"
+    "sync"
+    "time"
+
+    "netron/models"
+)
+
+// schedulePlan is the validated form of a models.SpeedTestSchedule.
+type schedulePlan struct {
+    config   models.SpeedTestSchedule
+    interval time.Duration
+    cron     *cronSpec
+    jitter   time.Duration
+    quiet    *quietHours
+}
+
+type quietHours struct {
+    start, end int // minutes since midnight
+}
+
+func parseQuietHours(s string) (*quietHours, error) {
+    startStr, endStr, ok := strings.Cut(s, "-")
+    if !ok {
+        return nil, fmt.Errorf("quiet hours must look like 23:00-06:00")
+    }
+    start, err := parseClock(startStr)
+    if err != nil {
+        return nil, err
+    }
+    end, err := parseClock(endStr)
+    if err != nil {
+        return nil, err
+    }
+    return &quietHours{start: start, end: end}, nil
+}
+
+func parseClock(s string) (int, error) {
+    t, err := time.Parse("15:04", strings.TrimSpace(s))
+    if err != nil {
+        return 0, fmt.Errorf("invalid time of day %q", s)
+    }
+    return t.Hour()*60 + t.Minute(), nil
+}
+
+func (q *quietHours) contains(t time.Time) bool {
+    m := t.Hour()*60 + t.Minute()
+    if q.start <= q.end {
+        return m >= q.start && m < q.end
+    }
+    // The window wraps past midnight.
+    return m >= q.start || m < q.end
+}
+
+// endAfter returns the end of the quiet window containing t.
+func (q *quietHours) endAfter(t time.Time) time.Time {
+    end := time.Date(t.Year(), t.Month(), t.Day(), q.end/60, q.end%60, 0, 0, t.Location())
+    if !end.After(t) {
+        end = end.AddDate(0, 0, 1)
+    }
+    return end
+}
+
+func newSchedulePlan(config models.SpeedTestSchedule) (*schedulePlan, error) {
+    config.NextRun = ""
+    plan := &schedulePlan{config: config}
+
+    if config.Backend != "" {
+        if _, _, err := lookupBackend(config.Backend); err != nil {
+            return nil, err
+        }
+    }
+    if config.Interval != "" && config.Cron != "" {
+        return nil, errors.New("interval and cron are mutually exclusive")
+    }
+    if config.Interval != "" {
+        d, err := time.ParseDuration(config.Interval)
+        if err != nil {
+            return nil, fmt.Errorf("invalid interval: %w", err)
+        }
+        if d < time.Minute {
+            return nil, errors.New("interval must be at least 1m")
+        }
+        plan.interval = d
+    }
+    if config.Cron != "" {
+        spec, err := parseCron(config.Cron)
+        if err != nil {
+            return nil, fmt.Errorf("invalid cron: %w", err)
+        }
+        plan.cron = spec
+    }
+    if config.Enabled && plan.interval == 0 && plan.cron == nil {
+        return nil, errors.New("an enabled schedule needs an interval or a cron expression")
+    }
+    if config.Jitter != "" {
+        d, err := time.ParseDuration(config.Jitter)
+        if err != nil || d < 0 {
+            return nil, fmt.Errorf("invalid jitter %q", config.Jitter)
+        }
+        plan.jitter = d
+    }
+    if config.QuietHours != "" {
+        quiet, err := parseQuietHours(config.QuietHours)
+        if err != nil {
+            return nil, err
+        }
+        plan.quiet = quiet
+    }
+    return plan, nil
+}
+
+// nextRun returns when the schedule should fire next after now, or the
+// zero time if it never fires.
+func (p *schedulePlan) nextRun(now time.Time) time.Time {
+    if !p.config.Enabled {
+        return time.Time{}
+    }
+
+    base := now
+    // Bounded so a quiet window covering every cron match cannot spin.
+    for i := 0; i < 1000; i++ {
+        var t time.Time
+        if p.cron != nil {
+            if t = p.cron.next(base); t.IsZero() {
+                return t
+            }
+        } else {
+            t = base.Add(p.interval)
+        }
+        if p.jitter > 0 {
+            t = t.Add(time.Duration(rand.Int63n(int64(p.jitter))))
+        }
+        if p.quiet == nil || !p.quiet.contains(t) {
+            return t
+        }
+        if p.cron != nil {
+            base = t
+        } else {
+            // Interval schedules resume as soon as the quiet window ends.
+            return p.quiet.endAfter(t)
+        }
+    }
+    return time.Time{}
+}
+
+var scheduler = struct {
+    sync.Mutex
+    plan   *schedulePlan
+    next   time.Time
+    reload chan struct{}
+}{
+    plan:   &schedulePlan{},
+    reload: make(chan struct{}, 1),
+}
+
+// StartSpeedTestScheduler validates config and starts running speed tests
+// on its schedule. It should be called once, even with a disabled config,
+// so that a schedule can later be set through the API.
+func StartSpeedTestScheduler(config models.SpeedTestSchedule) error {
+    plan, err := newSchedulePlan(config)
+    if err != nil {
+        return err
+    }
+    setSchedulePlan(plan)
+
+    go runScheduler()
+    return nil
+}
+
+func setSchedulePlan(plan *schedulePlan) {
+    scheduler.Lock()
+    scheduler.plan = plan
+    scheduler.next = plan.nextRun(time.Now())
+    scheduler.Unlock()
+}
+
+func runScheduler() {
+    for {
+        scheduler.Lock()
+        next := scheduler.next
+        scheduler.Unlock()
+
+        var timer *time.Timer
+        var fire <-chan time.Time
+        if !next.IsZero() {
+            timer = time.NewTimer(time.Until(next))
+            fire = timer.C
+        }
+
+        select {
+        case <-fire:
+            scheduler.Lock()
+            req := models.SpeedTestRequest{Backend: scheduler.plan.config.Backend}
+            scheduler.Unlock()
+            if err := startSpeedTest("schedule", req); err == errSpeedTestRunning {
+                log.Println("Scheduled speed test skipped: a test is already running")
+            } else if err != nil {
+                log.Printf("Scheduled speed test failed to start: %v", err)
+            }
+            scheduler.Lock()
+            scheduler.next = scheduler.plan.nextRun(time.Now())
+            scheduler.Unlock()
+        case <-scheduler.reload:
+            if timer != nil {
+                timer.Stop()
+            }
+        }
+    }
+}
+
+func currentSchedule() models.SpeedTestSchedule {
+    scheduler.Lock()
+    defer scheduler.Unlock()
+
+    config := scheduler.plan.config
+    if !scheduler.next.IsZero() {
+        config.NextRun = scheduler.next.Format(time.RFC3339)
+    }
+    return config
+}
+
+func GetSpeedTestSchedule(w http.ResponseWriter, r *http.Request) {
+    writeJSON(w, http.StatusOK, currentSchedule())
+}
+
+func UpdateSpeedTestSchedule(w http.ResponseWriter, r *http.Request) {
+    var config models.SpeedTestSchedule
+    if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+        writeError(w, http.StatusBadRequest, "Invalid schedule: "+err.Error())
+        return
+    }
+    plan, err := newSchedulePlan(config)
+    if err != nil {
+        writeError(w, http.StatusBadRequest, err.Error())
+        return
+    }
+    setSchedulePlan(plan)
+
+    select {
+    case scheduler.reload <- struct{}{}:
+    default:
+    }
+
+    writeJSON(w, http.StatusOK, currentSchedule())
+}
@@ -0,0 +1,163 @@
+package handlers
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "net"
+    "net/http"
+    "sort"
+    "strconv"
+    "sync"
+    "time"
+
+    "netron/models"
+)
+
+const (
+    serverProbeTimeout = 2 * time.Second
+    serverProbeWorkers = 8
+    serverListTimeout  = 30 * time.Second
+    defaultServerLimit = 20
+    maxServerLimit     = 100
+)
+
+// SpeedTestServerLister is implemented by backends that choose among a set
+// of public servers. Servers are returned best first.
+type SpeedTestServerLister interface {
+    Servers(ctx context.Context) ([]models.SpeedTestServer, error)
+}
+
+// formatServer renders a server as "Name (Location, Country)".
+func formatServer(s models.SpeedTestServer) string {
+    place := s.Location
+    if s.Country != "" {
+        if place != "" {
+            place += ", "
+        }
+        place += s.Country
+    }
+    if place == "" {
+        return s.Name
+    }
+    return fmt.Sprintf("%s (%s)", s.Name, place)
+}
+
+// probeServers sets the latency of each server with a known host to its TCP
+// connect time, then sorts the servers by it. Unreachable servers keep a
+// latency of zero and go last, in their original order.
+func probeServers(ctx context.Context, servers []models.SpeedTestServer) {
+    jobs := make(chan int)
+    var wg sync.WaitGroup
+    for i := 0; i < serverProbeWorkers; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            dialer := net.Dialer{Timeout: serverProbeTimeout}
+            for j := range jobs {
+                start := time.Now()
+                conn, err := dialer.DialContext(ctx, "tcp", servers[j].Host)
+                if err != nil {
+                    continue
+                }
+                servers[j].Latency = float64(time.Since(start)) / float64(time.Millisecond)
+                conn.Close()
+            }
+        }()
+    }
+    for i := range servers {
+        if servers[i].Host != "" {
+            jobs <- i
+        }
+    }
+    close(jobs)
+    wg.Wait()
+
+    sort.SliceStable(servers, func(i, j int) bool {
+        a, b := servers[i].Latency, servers[j].Latency
+        if a == 0 || b == 0 {
+            return b == 0 && a != 0
+        }
+        return a < b
+    })
+}
+
+// pickServer returns the best server offered by lister that is not in
+// exclude.
+func pickServer(ctx context.Context, lister SpeedTestServerLister, exclude []string) (models.SpeedTestServer, error) {
+    servers, err := lister.Servers(ctx)
+    if err != nil {
+        return models.SpeedTestServer{}, err
+    }
+    for _, s := range servers {
+        if !containsString(exclude, s.ID) {
+            return s, nil
+        }
+    }
+    return models.SpeedTestServer{}, errors.New("every candidate server is excluded")
+}
+
+func containsString(list []string, s string) bool {
+    for _, v := range list {
+        if v == s {
+            return true
+        }
+    }
+    return false
+}
+
+// checkServerSelection rejects exclusions the backend cannot honour and a
+// pinned server that is also excluded.
+func checkServerSelection(name string, backend SpeedTestBackend, req models.SpeedTestRequest) error {
+    if len(req.Exclude) == 0 {
+        return nil
+    }
+    if _, ok := backend.(SpeedTestServerLister); !ok {
+        return fmt.Errorf("speed test backend %q does not support excluding servers", name)
+    }
+    if containsString(req.Exclude, req.Server) {
+        return fmt.Errorf("server %s is both pinned and excluded", req.Server)
+    }
+    return nil
+}
+
+// GetSpeedTestServers lists the candidate servers of a backend:
+// /api/speedtest/servers?backend=ookla&limit=20.
+func GetSpeedTestServers(w http.ResponseWriter, r *http.Request) {
+    query := r.URL.Query()
+    name, backend, err := lookupBackend(query.Get("backend"))
+    if err != nil {
+        writeError(w, http.StatusBadRequest, err.Error())
+        return
+    }
+    lister, ok := backend.(SpeedTestServerLister)
+    if !ok {
+        writeError(w, http.StatusBadRequest, fmt.Sprintf("speed test backend %q does not list servers", name))
+        return
+    }
+
+    limit := defaultServerLimit
+    if v := query.Get("limit"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n < 1 {
+            writeError(w, http.StatusBadRequest, "invalid limit")
+            return
+        }
+        limit = min(n, maxServerLimit)
+    }
+
+    ctx, cancel := context.WithTimeout(r.Context(), serverListTimeout)
+    defer cancel()
+    servers, err := lister.Servers(ctx)
+    if err != nil {
+        writeError(w, http.StatusBadGateway, err.Error())
+        return
+    }
+    if servers == nil {
+        servers = []models.SpeedTestServer{}
+    }
+    if len(servers) > limit {
+        servers = servers[:limit]
+    }
+    writeJSON(w, http.StatusOK, models.SpeedTestServerList{Backend: name, Servers: servers})
+}
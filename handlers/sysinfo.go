@@ -14,6 +14,8 @@ import (
 )
 
 func getSystemDetails() models.SystemDetails {
+    ipv4, ipv6 := getReachability()
+    location := getHostLocation()
     return models.SystemDetails{
         OS:             getOS(),
         Kernel:         getKernel(),
@@ -22,11 +24,13 @@ func getSystemDetails() models.SystemDetails {
         LoadAverage:    getLoadAverage(),
         TCPCongestion:  getTCPCongestion(),
         Virtualization: getVirtualization(),
-        IPv4Status:     getIPv4Status(),
-        IPv6Status:     getIPv6Status(),
-        Organization:   getOrganization(),
-        Location:       getLocation(),
-        Region:         getRegion(),
+        IPv4Status:     ipv4,
+        IPv6Status:     ipv6,
+        PublicIPv4:     location.ipv4,
+        PublicIPv6:     location.ipv6,
+        Organization:   getOrganization(location),
+        Location:       getLocation(location),
+        Region:         getRegion(location),
         TotalDisk:      getTotalDisk(),
         UsedDisk:       getUsedDisk(),
     }
@@ -89,8 +93,8 @@ func getLoadAverage() string {
 }
 
 func getTCPCongestion() string {
-    if output, err := exec.Command("sysctl", "-n", "net.ipv4.tcp_congestion_control").Output(); err == nil {
-        return strings.TrimSpace(string(output))
+    if value, err := readSysctl("net.ipv4.tcp_congestion_control"); err == nil {
+        return value
     }
     return "Unknown"
 }
@@ -136,67 +140,30 @@ func getVirtualization() string {
     return "Dedicated"
 }
 
-func getIPv4Status() string {
-    if err := exec.Command("ping", "-4", "-c", "1", "-W", "4", "8.8.8.8").Run(); err == nil {
-        return "✓ Online"
-    }
-    return "✗ Offline"
-}
-
-func getIPv6Status() string {
-    if err := exec.Command("ping", "-6", "-c", "1", "-W", "4", "2001:4860:4860::8888").Run(); err == nil {
-        return "✓ Online"
-    }
-    return "✗ Offline"
-}
-
-func getOrganization() string {
-    if output, err := exec.Command("wget", "-q", "-T10", "-O-", "http://ipinfo.io/org").Output(); err == nil {
-        return strings.TrimSpace(string(output))
-    }
-    return "Unknown"
-}
-
-func getLocation() string {
-    cmd1 := exec.Command("wget", "-q", "-T10", "-O-", "http://ipinfo.io/city")
-    cmd2 := exec.Command("wget", "-q", "-T10", "-O-", "http://ipinfo.io/country")
-    
-    city, err1 := cmd1.Output()
-    country, err2 := cmd2.Output()
-    
-    if err1 == nil && err2 == nil {
-        return fmt.Sprintf("%s / %s", strings.TrimSpace(string(city)), strings.TrimSpace(string(country)))
-    }
-    return "Unknown"
-}
-
-func getRegion() string {
-    if output, err := exec.Command("wget", "-q", "-T10", "-O-", "http://ipinfo.io/region").Output(); err == nil {
-        return strings.TrimSpace(string(output))
-    }
-    return "Unknown"
-}
-
 func getTotalDisk() string {
-    var stat syscall.Statfs_t
-    if err := syscall.Statfs("/", &stat); err == nil {
-        total := stat.Blocks * uint64(stat.Bsize)
+    if total, _, ok := getDiskUsage("/"); ok {
         return formatBytes(total)
     }
     return "Unknown"
 }
 
 func getUsedDisk() string {
-    var stat syscall.Statfs_t
-    if err := syscall.Statfs("/", &stat); err == nil {
-        total := stat.Blocks * uint64(stat.Bsize)
-        available := stat.Bavail * uint64(stat.Bsize)
-        used := total - available
+    if _, used, ok := getDiskUsage("/"); ok {
         return formatBytes(used)
     }
     return "Unknown"
 }
 
+func getDiskUsage(path string) (total, used uint64, ok bool) {
+    var stat syscall.Statfs_t
+    if err := syscall.Statfs(path, &stat); err != nil {
+        return 0, 0, false
+    }
+    total = stat.Blocks * uint64(stat.Bsize)
+    available := stat.Bavail * uint64(stat.Bsize)
+    return total, total - available, true
+}
+
 func formatBytes(bytes uint64) string {
     const unit = 1024
     if bytes < unit {
@@ -253,9 +220,19 @@ func getCPUInfoDetailed() models.CPUInfo {
 }
 
 func getCPUUsage() float64 {
+    idle, total, ok := readCPUTimes()
+    if !ok || total == 0 {
+        return 0
+    }
+    return float64(total-idle) / float64(total) * 100
+}
+
+// readCPUTimes returns the idle and total jiffies of the aggregate cpu line
+// in /proc/stat.
+func readCPUTimes() (idle, total uint64, ok bool) {
     file, err := os.Open("/proc/stat")
     if err != nil {
-        return 0
+        return 0, 0, false
     }
     defer file.Close()
 
@@ -265,21 +242,15 @@ func getCPUUsage() float64 {
     fields := strings.Fields(line)
 
     if len(fields) < 8 {
-        return 0
+        return 0, 0, false
     }
 
-    idle, _ := strconv.ParseUint(fields[4], 10, 64)
-    total := uint64(0)
+    idle, _ = strconv.ParseUint(fields[4], 10, 64)
     for i := 1; i < len(fields); i++ {
         val, _ := strconv.ParseUint(fields[i], 10, 64)
         total += val
     }
-
-    if total == 0 {
-        return 0
-    }
-    
-    return float64(total-idle) / float64(total) * 100
+    return idle, total, true
 }
 
 func getCoreCount() int {
@@ -0,0 +1,205 @@
+package handlers
+
+import (
+    "errors"
+    "log"
+    "net"
+    "net/http"
+    "sort"
+    "strconv"
+    "sync"
+    "time"
+
+    "netron/models"
+    "netron/netlink"
+)
+
+const (
+    defaultTalkerLimit = 10
+    maxTalkerLimit     = 100
+)
+
+// TalkersConfig sets how often the TCP sockets are sampled for the top
+// talkers. An Interval of zero disables them.
+type TalkersConfig struct {
+    Interval time.Duration
+}
+
+type flowCounters struct {
+    acked    uint64
+    received uint64
+}
+
+var (
+    talkersMutex   sync.Mutex
+    talkers        *models.TopTalkers
+    talkersEnabled bool
+)
+
+// StartTopTalkers samples the byte counters of every TCP socket each
+// cfg.Interval and ranks flows, remote hosts and local processes by their
+// throughput between the last two samples.
+func StartTopTalkers(cfg TalkersConfig) error {
+    if cfg.Interval == 0 {
+        return nil
+    }
+    if cfg.Interval < time.Second {
+        return errors.New("the top talkers interval must be at least 1s")
+    }
+    if _, err := netlink.TCPSockets(); err != nil {
+        log.Printf("Top talkers unavailable: %v", err)
+        return nil
+    }
+    talkersEnabled = true
+
+    go func() {
+        ticker := time.NewTicker(cfg.Interval)
+        defer ticker.Stop()
+
+        var previous map[uint64]flowCounters
+        var previousTime time.Time
+        for now := time.Now(); ; now = <-ticker.C {
+            sockets, err := netlink.TCPSockets()
+            if err != nil {
+                log.Printf("Top talkers: %v", err)
+                continue
+            }
+            current := make(map[uint64]flowCounters, len(sockets))
+            for _, s := range sockets {
+                if s.HasBytes && s.Remote.Port() != 0 {
+                    current[s.Cookie] = flowCounters{acked: s.BytesAcked, received: s.BytesReceived}
+                }
+            }
+            if previous != nil {
+                ranked := rankTalkers(sockets, previous, now.Sub(previousTime))
+                ranked.Timestamp = now.Format(time.RFC3339)
+                talkersMutex.Lock()
+                talkers = ranked
+                talkersMutex.Unlock()
+            }
+            previous, previousTime = current, now
+        }
+    }()
+    return nil
+}
+
+// rankTalkers turns the growth of each socket's counters since the
+// previous sample into rates. Sockets opened since then count from zero;
+// sockets closed in between are not seen at all.
+func rankTalkers(sockets []netlink.TCPSocket, previous map[uint64]flowCounters, elapsed time.Duration) *models.TopTalkers {
+    seconds := elapsed.Seconds()
+    result := &models.TopTalkers{
+        Interval:  seconds,
+        Hosts:     []models.Talker{},
+        Processes: []models.Talker{},
+        Flows:     []models.TalkerFlow{},
+    }
+
+    var owners map[uint64]socketOwner
+    hosts := make(map[string]*models.Talker)
+    processes := make(map[int]*models.Talker)
+    for _, s := range sockets {
+        if !s.HasBytes || s.Remote.Port() == 0 {
+            continue
+        }
+        before := previous[s.Cookie]
+        if s.BytesAcked < before.acked || s.BytesReceived < before.received {
+            before = flowCounters{}
+        }
+        tx := float64(s.BytesAcked-before.acked) / seconds
+        rx := float64(s.BytesReceived-before.received) / seconds
+        if tx == 0 && rx == 0 {
+            continue
+        }
+
+        if owners == nil {
+            owners = socketOwners()
+        }
+        owner := owners[uint64(s.Inode)]
+        result.Flows = append(result.Flows, models.TalkerFlow{
+            Local:   s.Local.String(),
+            Remote:  s.Remote.String(),
+            PID:     owner.pid,
+            Process: owner.name,
+            RxRate:  rx,
+            TxRate:  tx,
+        })
+
+        ip := s.Remote.Addr().String()
+        if hosts[ip] == nil {
+            hosts[ip] = &models.Talker{Name: ip}
+        }
+        addTalkerRate(hosts[ip], rx, tx)
+
+        if processes[owner.pid] == nil {
+            name := owner.name
+            if owner.pid == 0 {
+                name = "unknown"
+            }
+            processes[owner.pid] = &models.Talker{Name: name, PID: owner.pid}
+        }
+        addTalkerRate(processes[owner.pid], rx, tx)
+    }
+
+    for _, t := range hosts {
+        result.Hosts = append(result.Hosts, *t)
+    }
+    for _, t := range processes {
+        result.Processes = append(result.Processes, *t)
+    }
+    sortTalkers(result.Hosts)
+    sortTalkers(result.Processes)
+    sort.Slice(result.Flows, func(i, j int) bool {
+        return result.Flows[i].RxRate+result.Flows[i].TxRate > result.Flows[j].RxRate+result.Flows[j].TxRate
+    })
+    return result
+}
+
+func addTalkerRate(t *models.Talker, rx, tx float64) {
+    t.Flows++
+    t.RxRate += rx
+    t.TxRate += tx
+}
+
+func sortTalkers(talkers []models.Talker) {
+    sort.Slice(talkers, func(i, j int) bool {
+        return talkers[i].RxRate+talkers[i].TxRate > talkers[j].RxRate+talkers[j].TxRate
+    })
+}
+
+// GetTopTalkers reports the busiest remote hosts, local processes and
+// flows of the last sampling interval, at most ?limit= of each.
+func GetTopTalkers(w http.ResponseWriter, r *http.Request) {
+    limit := defaultTalkerLimit
+    if v := r.URL.Query().Get("limit"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n < 1 {
+            writeError(w, http.StatusBadRequest, "invalid limit")
+            return
+        }
+        limit = min(n, maxTalkerLimit)
+    }
+
+    if !talkersEnabled {
+        writeError(w, http.StatusServiceUnavailable, "Top talkers are disabled")
+        return
+    }
+    talkersMutex.Lock()
+    latest := talkers
+    talkersMutex.Unlock()
+    if latest == nil {
+        writeError(w, http.StatusServiceUnavailable, "Top talkers are not sampled yet")
+        return
+    }
+
+    result := *latest
+    result.Hosts = append([]models.Talker{}, result.Hosts[:min(limit, len(result.Hosts))]...)
+    result.Processes = result.Processes[:min(limit, len(result.Processes))]
+    result.Flows = result.Flows[:min(limit, len(result.Flows))]
+    if enrichEnabled {
+        for i := range result.Hosts {
+            result.Hosts[i].Remote = enrichAddress(net.JoinHostPort(result.Hosts[i].Name, "0"))
+        }
+    }
+    writeJSON(w, http.StatusOK, result)
+}
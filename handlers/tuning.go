@@ -0,0 +1,197 @@
+package handlers
+
+import (
+    "io/ioutil"
+    "net/http"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+
+    "netron/models"
+)
+
+const (
+    TuningServer     = "server"
+    TuningThroughput = "throughput"
+    TuningRouter     = "router"
+)
+
+var tuningProfiles = []string{TuningServer, TuningThroughput, TuningRouter}
+
+// tuningRule is what a profile expects of a setting. check is given the
+// setting's value with whitespace collapsed.
+type tuningRule struct {
+    recommended string
+    check       func(value string) bool
+    note        string
+}
+
+type tuningSetting struct {
+    name        string
+    description string
+    rules       map[string]tuningRule
+}
+
+func valueIs(want string) func(string) bool {
+    return func(value string) bool { return value == want }
+}
+
+// valueAtLeast checks a single number, or the last one of a
+// "min default max" triple such as tcp_rmem.
+func valueAtLeast(want int64) func(string) bool {
+    return func(value string) bool {
+        fields := strings.Fields(value)
+        if len(fields) == 0 {
+            return false
+        }
+        n, err := strconv.ParseInt(fields[len(fields)-1], 10, 64)
+        return err == nil && n >= want
+    }
+}
+
+func valueAtMost(want int64) func(string) bool {
+    return func(value string) bool {
+        n, err := strconv.ParseInt(value, 10, 64)
+        return err == nil && n <= want
+    }
+}
+
+func valueOneOf(want ...string) func(string) bool {
+    return func(value string) bool { return containsString(want, value) }
+}
+
+var (
+    bufferRule    = tuningRule{"16777216", valueAtLeast(16 << 20), "Larger buffers let single flows fill high bandwidth-delay paths"}
+    bufferMaxRule = tuningRule{"max 16777216", valueAtLeast(16 << 20), "Larger buffers let single flows fill high bandwidth-delay paths"}
+    backlogRule   = tuningRule{"16384", valueAtLeast(16384), "Avoids drops when packets arrive faster than they are processed"}
+)
+
+var tuningSettings = []tuningSetting{
+    {"net.ipv4.tcp_congestion_control", "TCP congestion control algorithm", map[string]tuningRule{
+        TuningThroughput: {"bbr", valueIs("bbr"), "BBR keeps throughput up on lossy and long paths"},
+    }},
+    {"net.ipv4.tcp_available_congestion_control", "Congestion control algorithms loaded", nil},
+    {"net.core.default_qdisc", "Default queueing discipline", map[string]tuningRule{
+        TuningServer:     {"fq or fq_codel", valueOneOf("fq", "fq_codel", "cake"), "Fair queueing avoids bufferbloat"},
+        TuningThroughput: {"fq", valueIs("fq"), "BBR paces best with fq"},
+        TuningRouter:     {"fq_codel or cake", valueOneOf("fq_codel", "cake"), "Active queue management keeps forwarding latency low"},
+    }},
+    {"net.core.rmem_max", "Maximum socket receive buffer", map[string]tuningRule{TuningThroughput: bufferRule}},
+    {"net.core.wmem_max", "Maximum socket send buffer", map[string]tuningRule{TuningThroughput: bufferRule}},
+    {"net.ipv4.tcp_rmem", "TCP receive buffer min, default and max", map[string]tuningRule{TuningThroughput: bufferMaxRule}},
+    {"net.ipv4.tcp_wmem", "TCP send buffer min, default and max", map[string]tuningRule{TuningThroughput: bufferMaxRule}},
+    {"net.core.somaxconn", "Maximum accept queue length", map[string]tuningRule{
+        TuningServer: {"4096", valueAtLeast(4096), "Short accept queues overflow under connection bursts"},
+    }},
+    {"net.ipv4.tcp_max_syn_backlog", "Maximum SYN queue length", map[string]tuningRule{
+        TuningServer: {"4096", valueAtLeast(4096), "Short SYN queues fall back to SYN cookies early"},
+    }},
+    {"net.ipv4.tcp_syncookies", "SYN cookies when the SYN queue is full", map[string]tuningRule{
+        TuningServer: {"1", valueIs("1"), "Protects listeners against SYN floods"},
+        TuningRouter: {"1", valueIs("1"), "Protects listeners against SYN floods"},
+    }},
+    {"net.core.netdev_max_backlog", "Packets queued per CPU before processing", map[string]tuningRule{
+        TuningThroughput: backlogRule,
+        TuningRouter:     backlogRule,
+    }},
+    {"net.ipv4.tcp_slow_start_after_idle", "Restart slow start after an idle period", map[string]tuningRule{
+        TuningServer:     {"0", valueIs("0"), "Keeps the congestion window of idle keep-alive connections"},
+        TuningThroughput: {"0", valueIs("0"), "Keeps the congestion window of idle keep-alive connections"},
+    }},
+    {"net.ipv4.tcp_mtu_probing", "Path MTU probing", map[string]tuningRule{
+        TuningThroughput: {"1", valueOneOf("1", "2"), "Recovers from paths that drop ICMP fragmentation needed messages"},
+    }},
+    {"net.ipv4.tcp_fastopen", "TCP Fast Open (1 client, 2 server, 3 both)", nil},
+    {"net.ipv4.ip_local_port_range", "Ephemeral port range", nil},
+    {"net.ipv4.ip_forward", "IPv4 forwarding", map[string]tuningRule{
+        TuningServer: {"0", valueIs("0"), "Only routers and container hosts need to forward"},
+        TuningRouter: {"1", valueIs("1"), "Required to route IPv4"},
+    }},
+    {"net.ipv6.conf.all.forwarding", "IPv6 forwarding", map[string]tuningRule{
+        TuningRouter: {"1", valueIs("1"), "Required to route IPv6"},
+    }},
+    {"net.ipv4.conf.all.rp_filter", "Reverse path filtering (1 strict, 2 loose)", map[string]tuningRule{
+        TuningRouter: {"1 or 2", valueOneOf("1", "2"), "Drops spoofed source addresses"},
+    }},
+    {"net.netfilter.nf_conntrack_max", "Maximum connection tracking entries", map[string]tuningRule{
+        TuningRouter: {"262144", valueAtLeast(262144), "A full table drops new connections"},
+    }},
+    {"vm.swappiness", "Tendency to swap out memory", map[string]tuningRule{
+        TuningServer: {"10", valueAtMost(10), "Keeps server processes in memory"},
+    }},
+    {"vm.min_free_kbytes", "Memory kept free for atomic allocations", map[string]tuningRule{
+        TuningThroughput: {"65536", valueAtLeast(65536), "Network receive paths allocate atomically at high packet rates"},
+        TuningRouter:     {"65536", valueAtLeast(65536), "Network receive paths allocate atomically at high packet rates"},
+    }},
+}
+
+// readSysctl reads a sysctl, such as net.core.somaxconn, from /proc/sys.
+// Multiple values are joined by single spaces.
+func readSysctl(name string) (string, error) {
+    data, err := ioutil.ReadFile(filepath.Join("/proc/sys", strings.ReplaceAll(name, ".", "/")))
+    if err != nil {
+        return "", err
+    }
+    return strings.Join(strings.Fields(string(data)), " "), nil
+}
+
+// bbrAvailable tells whether BBR is loaded or can be loaded as a module.
+func bbrAvailable() bool {
+    if available, err := readSysctl("net.ipv4.tcp_available_congestion_control"); err == nil {
+        if containsString(strings.Fields(available), "bbr") {
+            return true
+        }
+    }
+    release, err := readSysctl("kernel.osrelease")
+    if err != nil {
+        return false
+    }
+    matches, _ := filepath.Glob(filepath.Join("/lib/modules", release, "kernel/net/ipv4/tcp_bbr.ko*"))
+    return len(matches) > 0
+}
+
+// GetTuning reports the kernel network settings and how they compare with
+// the recommendations of ?profile=server (the default), throughput or
+// router.
+func GetTuning(w http.ResponseWriter, r *http.Request) {
+    profile := r.URL.Query().Get("profile")
+    if profile == "" {
+        profile = TuningServer
+    }
+    if !containsString(tuningProfiles, profile) {
+        writeError(w, http.StatusBadRequest, "profile must be one of "+strings.Join(tuningProfiles, ", "))
+        return
+    }
+
+    report := models.TuningReport{
+        Profile:      profile,
+        Profiles:     tuningProfiles,
+        BBRAvailable: bbrAvailable(),
+    }
+    for _, s := range tuningSettings {
+        setting := models.TuningSetting{Name: s.name, Description: s.description}
+        value, err := readSysctl(s.name)
+        if err != nil {
+            if !os.IsNotExist(err) {
+                setting.Note = err.Error()
+            }
+            setting.Status = "unavailable"
+            report.Settings = append(report.Settings, setting)
+            continue
+        }
+        setting.Value = value
+
+        if rule, ok := s.rules[profile]; ok {
+            setting.Recommended = rule.recommended
+            setting.Status = "ok"
+            if !rule.check(value) {
+                setting.Status = "deviates"
+                setting.Note = rule.note
+                report.Deviations++
+            }
+        }
+        report.Settings = append(report.Settings, setting)
+    }
+    writeJSON(w, http.StatusOK, report)
+}
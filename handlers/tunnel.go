@@ -0,0 +1,111 @@
+package handlers
+
+import (
+    "io/ioutil"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+
+    "netron/models"
+
+    "golang.zx2c4.com/wireguard/wgctrl"
+)
+
+// Flags of /sys/class/net/<name>/tun_flags from linux/if_tun.h.
+const (
+    iffTun = 0x0001
+    iffTap = 0x0002
+)
+
+// tunnelTypes maps the ARPHRD_* hardware types of linux/if_arp.h to the
+// tunnels that use them.
+var tunnelTypes = map[string]string{
+    "768": "ipip",
+    "769": "ip6tnl",
+    "776": "sit",
+    "778": "gre",
+    "823": "ip6gre",
+}
+
+func readNetClass(name, file string) string {
+    data, err := ioutil.ReadFile("/sys/class/net/" + name + "/" + file)
+    if err != nil {
+        return ""
+    }
+    return strings.TrimSpace(string(data))
+}
+
+// interfaceKind names the kind of a virtual interface, such as wireguard,
+// tun, tap, gre or bridge, and is empty for physical ones.
+func interfaceKind(name string) string {
+    if flags := readNetClass(name, "tun_flags"); flags != "" {
+        if n, err := strconv.ParseUint(strings.TrimPrefix(flags, "0x"), 16, 32); err == nil {
+            if n&iffTap != 0 {
+                return "tap"
+            }
+            if n&iffTun != 0 {
+                return "tun"
+            }
+        }
+    }
+    for _, line := range strings.Split(readNetClass(name, "uevent"), "\n") {
+        if kind, ok := strings.CutPrefix(line, "DEVTYPE="); ok {
+            return kind
+        }
+    }
+    return tunnelTypes[readNetClass(name, "type")]
+}
+
+// addWireGuardPeers attaches the configuration and peers of WireGuard
+// interfaces, both kernel ones and userspace ones such as wireguard-go on a
+// tun device. Private and preshared keys are never read out of the device.
+func addWireGuardPeers(interfaces []models.InterfaceInfo) {
+    client, err := wgctrl.New()
+    if err != nil {
+        return
+    }
+    defer client.Close()
+
+    devices, err := client.Devices()
+    if err != nil || len(devices) == 0 {
+        return
+    }
+    for i := range interfaces {
+        for _, device := range devices {
+            if device.Name != interfaces[i].Name {
+                continue
+            }
+            wg := &models.WireGuardInfo{
+                Implementation: device.Type.String(),
+                PublicKey:      device.PublicKey.String(),
+                ListenPort:     device.ListenPort,
+                Peers:          []models.WireGuardPeer{},
+            }
+            for _, p := range device.Peers {
+                peer := models.WireGuardPeer{
+                    PublicKey:  p.PublicKey.String(),
+                    AllowedIPs: []string{},
+                    RxBytes:    p.ReceiveBytes,
+                    TxBytes:    p.TransmitBytes,
+                    Keepalive:  int(p.PersistentKeepaliveInterval / time.Second),
+                }
+                if p.Endpoint != nil {
+                    peer.Endpoint = p.Endpoint.String()
+                }
+                for _, ip := range p.AllowedIPs {
+                    peer.AllowedIPs = append(peer.AllowedIPs, ip.String())
+                }
+                if !p.LastHandshakeTime.IsZero() {
+                    peer.LatestHandshake = p.LastHandshakeTime.Format(time.RFC3339)
+                    peer.HandshakeAge = int64(time.Since(p.LastHandshakeTime) / time.Second)
+                }
+                wg.Peers = append(wg.Peers, peer)
+            }
+            sort.Slice(wg.Peers, func(a, b int) bool {
+                return wg.Peers[a].LatestHandshake > wg.Peers[b].LatestHandshake
+            })
+            interfaces[i].WireGuard = wg
+        }
+    }
+}
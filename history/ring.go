@@ -0,0 +1,150 @@
+package history
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"time"
+)
+
+// A ring file is a fixed size header followed by one fixed size slot per
+// bucket of the tier. Slots are overwritten in place, so the file never
+// grows past its initial size and a crash loses at most the slot that was
+// being written.
+const (
+	ringMagic  = "NTRNRING"
+	headerSize = 32
+	slotSize   = 24
+)
+
+type slot struct {
+	ts    int64
+	sum   float64
+	count uint64
+}
+
+type ring struct {
+	res   int64
+	slots []slot
+	file  *os.File
+}
+
+func newRing(tier Tier) *ring {
+	return &ring{
+		res:   int64(tier.Resolution / time.Second),
+		slots: make([]slot, tier.slots()),
+	}
+}
+
+// openRing loads the ring stored at path, creating it when it is missing or
+// was written with a different tier layout.
+func openRing(path string, tier Tier) (*ring, error) {
+	r := newRing(tier)
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	r.file = f
+
+	if err := r.load(); err != nil {
+		if err := r.reset(); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func (r *ring) load() error {
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(r.file, header); err != nil {
+		return err
+	}
+	if string(header[:8]) != ringMagic {
+		return errors.New("bad magic")
+	}
+	res := int64(binary.LittleEndian.Uint64(header[8:]))
+	n := int64(binary.LittleEndian.Uint64(header[16:]))
+	if res != r.res || n != int64(len(r.slots)) {
+		return fmt.Errorf("layout changed")
+	}
+
+	data := make([]byte, len(r.slots)*slotSize)
+	if _, err := io.ReadFull(r.file, data); err != nil {
+		return err
+	}
+	for i := range r.slots {
+		b := data[i*slotSize:]
+		r.slots[i] = slot{
+			ts:    int64(binary.LittleEndian.Uint64(b)),
+			sum:   math.Float64frombits(binary.LittleEndian.Uint64(b[8:])),
+			count: binary.LittleEndian.Uint64(b[16:]),
+		}
+	}
+	return nil
+}
+
+func (r *ring) reset() error {
+	for i := range r.slots {
+		r.slots[i] = slot{}
+	}
+	if err := r.file.Truncate(0); err != nil {
+		return err
+	}
+
+	header := make([]byte, headerSize)
+	copy(header, ringMagic)
+	binary.LittleEndian.PutUint64(header[8:], uint64(r.res))
+	binary.LittleEndian.PutUint64(header[16:], uint64(len(r.slots)))
+	if _, err := r.file.WriteAt(header, 0); err != nil {
+		return err
+	}
+	return r.file.Truncate(int64(headerSize + len(r.slots)*slotSize))
+}
+
+// add folds a sample taken at unix time ts into its bucket, discarding
+// whatever the slot held from a previous lap around the ring.
+func (r *ring) add(ts int64, v float64) error {
+	bucket := ts - ts%r.res
+	i := int((bucket / r.res) % int64(len(r.slots)))
+
+	s := &r.slots[i]
+	if s.ts != bucket {
+		*s = slot{ts: bucket}
+	}
+	s.sum += v
+	s.count++
+
+	if r.file == nil {
+		return nil
+	}
+	b := make([]byte, slotSize)
+	binary.LittleEndian.PutUint64(b, uint64(s.ts))
+	binary.LittleEndian.PutUint64(b[8:], math.Float64bits(s.sum))
+	binary.LittleEndian.PutUint64(b[16:], s.count)
+	_, err := r.file.WriteAt(b, int64(headerSize+i*slotSize))
+	return err
+}
+
+// last is the start of the most recent bucket holding samples, or zero for
+// an empty ring.
+func (r *ring) last() int64 {
+	var latest int64
+	for _, s := range r.slots {
+		if s.count > 0 && s.ts > latest {
+			latest = s.ts
+		}
+	}
+	return latest
+}
+
+func (r *ring) close() error {
+	if r.file == nil {
+		return nil
+	}
+	return r.file.Close()
+}
@@ -0,0 +1,116 @@
+package history
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRingWraparound(t *testing.T) {
+	// Four one-second slots, so second 4 lands where second 0 was.
+	r := newRing(Tier{Resolution: time.Second, Retention: 4 * time.Second})
+	for ts := int64(100); ts < 106; ts++ {
+		if err := r.add(ts, float64(ts)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.add(105, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[int64]slot{
+		102: {ts: 102, sum: 102, count: 1},
+		103: {ts: 103, sum: 103, count: 1},
+		104: {ts: 104, sum: 104, count: 1},
+		105: {ts: 105, sum: 106, count: 2},
+	}
+	for _, s := range r.slots {
+		if s != want[s.ts] {
+			t.Errorf("slot %+v, want %+v", s, want[s.ts])
+		}
+		delete(want, s.ts)
+	}
+	if len(want) != 0 {
+		t.Errorf("missing slots %v", want)
+	}
+	if last := r.last(); last != 105 {
+		t.Errorf("last = %d, want 105", last)
+	}
+}
+
+func TestRingReopen(t *testing.T) {
+	tier := Tier{Resolution: time.Minute, Retention: time.Hour}
+	path := filepath.Join(t.TempDir(), "metric.ring")
+
+	r, err := openRing(path, tier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ts := range []int64{600, 630, 660} {
+		if err := r.add(ts, 3); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := append([]slot(nil), r.slots...)
+	r.close()
+	saved, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		tier   Tier
+		before func()
+		kept   bool
+	}{
+		{"same layout", tier, nil, true},
+		{"other resolution", Tier{Resolution: 2 * time.Minute, Retention: time.Hour}, nil, false},
+		{"other retention", Tier{Resolution: time.Minute, Retention: 2 * time.Hour}, nil, false},
+		{"bad magic", tier, func() { writeFile(t, path, []byte("NOTARING")) }, false},
+		{"short file", tier, func() { truncate(t, path, headerSize+slotSize) }, false},
+		{"empty file", tier, func() { writeFile(t, path, nil) }, false},
+	}
+	for _, tt := range tests {
+		writeFile(t, path, saved)
+		if tt.before != nil {
+			tt.before()
+		}
+		r, err := openRing(path, tt.tier)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size := int64(headerSize + tt.tier.slots()*slotSize); info.Size() != size {
+			t.Errorf("%s: file size %d, want %d", tt.name, info.Size(), size)
+		}
+		if tt.kept {
+			for i := range want {
+				if r.slots[i] != want[i] {
+					t.Errorf("%s: slot %d = %+v, want %+v", tt.name, i, r.slots[i], want[i])
+				}
+			}
+		} else if last := r.last(); last != 0 {
+			t.Errorf("%s: ring kept samples up to %d after a reset", tt.name, last)
+		}
+		r.close()
+	}
+}
+
+func writeFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func truncate(t *testing.T, path string, size int64) {
+	t.Helper()
+	if err := os.Truncate(path, size); err != nil {
+		t.Fatal(err)
+	}
+}
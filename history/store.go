@@ -0,0 +1,263 @@
+// Package history is a small embedded time-series store. Every metric is
+// kept in one fixed size ring per retention tier, so disk and memory usage
+// are bounded by the tier configuration rather than by uptime.
+package history
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"netron/models"
+)
+
+var ErrUnknownMetric = errors.New("unknown metric")
+
+type Store struct {
+	mu     sync.RWMutex
+	dir    string
+	tiers  []Tier
+	series map[string][]*ring
+}
+
+// Open opens the store rooted at dir, loading any metrics recorded by a
+// previous run. An empty dir keeps the store in memory only.
+func Open(dir string, tiers []Tier) (*Store, error) {
+	if len(tiers) == 0 {
+		return nil, errors.New("at least one tier is required")
+	}
+
+	s := &Store{
+		dir:    dir,
+		tiers:  tiers,
+		series: make(map[string][]*ring),
+	}
+	if dir == "" {
+		return s, nil
+	}
+
+	for _, tier := range tiers {
+		if err := os.MkdirAll(s.tierDir(tier), 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	files, err := filepath.Glob(filepath.Join(s.tierDir(tiers[0]), "*.ring"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		metric := strings.TrimSuffix(filepath.Base(file), ".ring")
+		if _, err := s.open(metric); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *Store) Tiers() []Tier {
+	return s.tiers
+}
+
+func (s *Store) tierDir(tier Tier) string {
+	return filepath.Join(s.dir, FormatSpan(tier.Resolution))
+}
+
+func (s *Store) open(metric string) ([]*ring, error) {
+	if rings, ok := s.series[metric]; ok {
+		return rings, nil
+	}
+	if !validMetric(metric) {
+		return nil, fmt.Errorf("invalid metric name %q", metric)
+	}
+
+	rings := make([]*ring, 0, len(s.tiers))
+	for _, tier := range s.tiers {
+		if s.dir == "" {
+			rings = append(rings, newRing(tier))
+			continue
+		}
+		r, err := openRing(filepath.Join(s.tierDir(tier), metric+".ring"), tier)
+		if err != nil {
+			for _, opened := range rings {
+				opened.close()
+			}
+			return nil, err
+		}
+		rings = append(rings, r)
+	}
+	s.series[metric] = rings
+	return rings, nil
+}
+
+// validMetric keeps metric names usable as file names.
+func validMetric(metric string) bool {
+	if metric == "" || metric[0] == '.' {
+		return false
+	}
+	for _, c := range metric {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("._-:@", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// Record adds a sample to every tier of metric, creating the metric on
+// first use.
+func (s *Store) Record(metric string, t time.Time, v float64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rings, err := s.open(metric)
+	if err != nil {
+		return err
+	}
+	ts := t.Unix()
+	for _, r := range rings {
+		if err := r.add(ts, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Prune closes and deletes the metrics without a sample for longer than
+// the retention of the coarsest tier, such as those of interfaces that went
+// away, and returns their names.
+func (s *Store) Prune(now time.Time) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cutoff := now.Add(-s.tiers[len(s.tiers)-1].Retention).Unix()
+	var pruned []string
+	var firstErr error
+	for metric, rings := range s.series {
+		if rings[len(rings)-1].last() >= cutoff {
+			continue
+		}
+		for i, r := range rings {
+			if err := r.close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+			if s.dir == "" {
+				continue
+			}
+			err := os.Remove(filepath.Join(s.tierDir(s.tiers[i]), metric+".ring"))
+			if err != nil && !errors.Is(err, os.ErrNotExist) && firstErr == nil {
+				firstErr = err
+			}
+		}
+		delete(s.series, metric)
+		pruned = append(pruned, metric)
+	}
+	sort.Strings(pruned)
+	return pruned, firstErr
+}
+
+// Metrics lists every metric the store holds, sorted by name.
+func (s *Store) Metrics() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	metrics := make([]string, 0, len(s.series))
+	for metric := range s.series {
+		metrics = append(metrics, metric)
+	}
+	sort.Strings(metrics)
+	return metrics
+}
+
+// Query returns the average of metric over consecutive step-sized buckets
+// between from and to. It reads from the finest tier that still covers from
+// and is no finer than needed for step. A zero step uses the resolution of
+// the chosen tier. The effective step is returned alongside the points.
+func (s *Store) Query(metric string, from, to time.Time, step time.Duration) ([]models.HistoryPoint, time.Duration, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rings, ok := s.series[metric]
+	if !ok {
+		return nil, 0, ErrUnknownMetric
+	}
+
+	idx := s.pickTier(from, step)
+	r := rings[idx]
+	if step < s.tiers[idx].Resolution {
+		step = s.tiers[idx].Resolution
+	}
+	stepSecs := int64(step / time.Second)
+
+	type bucket struct {
+		sum   float64
+		count uint64
+	}
+	buckets := make(map[int64]*bucket)
+	fromTS, toTS := from.Unix(), to.Unix()
+	for _, sl := range r.slots {
+		if sl.count == 0 || sl.ts < fromTS-fromTS%r.res || sl.ts > toTS {
+			continue
+		}
+		key := sl.ts - sl.ts%stepSecs
+		b, ok := buckets[key]
+		if !ok {
+			b = &bucket{}
+			buckets[key] = b
+		}
+		b.sum += sl.sum
+		b.count += sl.count
+	}
+
+	points := make([]models.HistoryPoint, 0, len(buckets))
+	for ts, b := range buckets {
+		points = append(points, models.HistoryPoint{Time: ts, Value: b.sum / float64(b.count)})
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].Time < points[j].Time })
+	return points, step, nil
+}
+
+func (s *Store) pickTier(from time.Time, step time.Duration) int {
+	age := time.Since(from)
+	for i, tier := range s.tiers {
+		if tier.Retention >= age && (step == 0 || tier.Resolution <= step) {
+			// Prefer a coarser tier when it still satisfies step, it
+			// means fewer slots to aggregate.
+			for j := i + 1; j < len(s.tiers); j++ {
+				if step == 0 || s.tiers[j].Resolution > step {
+					break
+				}
+				i = j
+			}
+			return i
+		}
+	}
+	// No tier is fine enough for step, fall back to the finest one that
+	// still covers from.
+	for i, tier := range s.tiers {
+		if tier.Retention >= age {
+			return i
+		}
+	}
+	return len(s.tiers) - 1
+}
+
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var firstErr error
+	for _, rings := range s.series {
+		for _, r := range rings {
+			if err := r.close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
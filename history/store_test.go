@@ -0,0 +1,184 @@
+package history
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"netron/models"
+)
+
+func mustParseTiers(t *testing.T, spec string) []Tier {
+	t.Helper()
+	tiers, err := ParseTiers(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tiers
+}
+
+func TestPickTier(t *testing.T) {
+	s, err := Open("", mustParseTiers(t, "1s:1h,1m:7d,1h:365d"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const day = 24 * time.Hour
+	tests := []struct {
+		age  time.Duration
+		step time.Duration
+		tier int
+	}{
+		{30 * time.Minute, 0, 0},
+		{30 * time.Minute, 30 * time.Second, 0},
+		{30 * time.Minute, time.Minute, 1},
+		{30 * time.Minute, 5 * time.Minute, 1},
+		{30 * time.Minute, time.Hour, 2},
+		{2 * time.Hour, 0, 1},
+		{2 * time.Hour, time.Second, 1},
+		{2 * time.Hour, 2 * time.Hour, 2},
+		{30 * day, 0, 2},
+		{2 * 365 * day, 0, 2},
+	}
+	for _, tt := range tests {
+		if got := s.pickTier(time.Now().Add(-tt.age), tt.step); got != tt.tier {
+			t.Errorf("pickTier(-%s, %s) = %d, want %d", tt.age, tt.step, got, tt.tier)
+		}
+	}
+}
+
+func TestQueryDownsampling(t *testing.T) {
+	s, err := Open("", mustParseTiers(t, "1s:1h,1m:1d"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// One minute of 1s, then one of 3s, then a single 10.
+	base := time.Now().Add(-30 * time.Minute).Truncate(10 * time.Minute)
+	for i := 0; i < 120; i++ {
+		v := 1.0
+		if i >= 60 {
+			v = 3
+		}
+		if err := s.Record("cpu.usage", base.Add(time.Duration(i)*time.Second), v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Record("cpu.usage", base.Add(2*time.Minute), 10); err != nil {
+		t.Fatal(err)
+	}
+	b := base.Unix()
+	pt := func(ts int64, v float64) models.HistoryPoint {
+		return models.HistoryPoint{Time: ts, Value: v}
+	}
+
+	tests := []struct {
+		step     time.Duration
+		wantStep time.Duration
+		points   []models.HistoryPoint
+	}{
+		{time.Minute, time.Minute, []models.HistoryPoint{pt(b, 1), pt(b+60, 3), pt(b+120, 10)}},
+		{2 * time.Minute, 2 * time.Minute, []models.HistoryPoint{pt(b, 2), pt(b+120, 10)}},
+		{30 * time.Second, 30 * time.Second, []models.HistoryPoint{pt(b, 1), pt(b+30, 1), pt(b+60, 3), pt(b+90, 3), pt(b+120, 10)}},
+	}
+	for _, tt := range tests {
+		points, step, err := s.Query("cpu.usage", base, base.Add(3*time.Minute), tt.step)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if step != tt.wantStep || !reflect.DeepEqual(points, tt.points) {
+			t.Errorf("step %s: got %v every %s, want %v every %s", tt.step, points, step, tt.points, tt.wantStep)
+		}
+	}
+
+	points, step, err := s.Query("cpu.usage", base, base.Add(3*time.Minute), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if step != time.Second || len(points) != 121 {
+		t.Errorf("step 0: got %d points every %s, want 121 every 1s", len(points), step)
+	}
+
+	if _, _, err := s.Query("memory.used", base, base.Add(time.Minute), 0); !errors.Is(err, ErrUnknownMetric) {
+		t.Errorf("unknown metric: got %v", err)
+	}
+	if err := s.Record("net.eth/0.rx_bps", base, 1); err == nil {
+		t.Error("recorded a metric name with a slash")
+	}
+}
+
+func TestStoreReopen(t *testing.T) {
+	dir := t.TempDir()
+	tiers := mustParseTiers(t, "1s:1h,1m:1d")
+	s, err := Open(dir, tiers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Truncate(time.Minute)
+	for i := 0; i < 90; i++ {
+		if err := s.Record("memory.used", now.Add(-time.Duration(i)*time.Second), float64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, _, err := s.Query("memory.used", now.Add(-2*time.Minute), now, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = Open(dir, tiers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if metrics := s.Metrics(); !reflect.DeepEqual(metrics, []string{"memory.used"}) {
+		t.Errorf("metrics after reopening: %v", metrics)
+	}
+	got, _, err := s.Query("memory.used", now.Add(-2*time.Minute), now, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) == 0 || !reflect.DeepEqual(got, want) {
+		t.Errorf("points after reopening: %v, want %v", got, want)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	dir := t.TempDir()
+	tiers := mustParseTiers(t, "1s:1m,1m:1h")
+	s, err := Open(dir, tiers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	now := time.Now()
+	if err := s.Record("net.veth1.rx_bps", now.Add(-2*time.Hour), 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Record("net.eth0.rx_bps", now.Add(-30*time.Minute), 1); err != nil {
+		t.Fatal(err)
+	}
+
+	pruned, err := s.Prune(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(pruned, []string{"net.veth1.rx_bps"}) {
+		t.Errorf("pruned %v", pruned)
+	}
+	if metrics := s.Metrics(); !reflect.DeepEqual(metrics, []string{"net.eth0.rx_bps"}) {
+		t.Errorf("metrics after pruning: %v", metrics)
+	}
+	for _, tier := range tiers {
+		if _, err := os.Stat(filepath.Join(s.tierDir(tier), "net.veth1.rx_bps.ring")); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("ring file of the pruned metric in %s: %v", tier, err)
+		}
+		if _, err := os.Stat(filepath.Join(s.tierDir(tier), "net.eth0.rx_bps.ring")); err != nil {
+			t.Errorf("ring file of the kept metric in %s: %v", tier, err)
+		}
+	}
+}
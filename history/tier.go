@@ -0,0 +1,106 @@
+package history
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Tier is one retention level of the store: samples are averaged into
+// buckets of Resolution and kept for Retention.
+type Tier struct {
+	Resolution time.Duration
+	Retention  time.Duration
+}
+
+func (t Tier) slots() int {
+	return int(t.Retention / t.Resolution)
+}
+
+func (t Tier) String() string {
+	return FormatSpan(t.Resolution) + ":" + FormatSpan(t.Retention)
+}
+
+// ParseTiers parses a comma separated list of resolution:retention pairs,
+// e.g. "1s:1h,1m:7d,1h:365d". Tiers are returned finest first.
+func ParseTiers(spec string) ([]Tier, error) {
+	var tiers []Tier
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		res, ret, ok := strings.Cut(part, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid tier %q: expected resolution:retention", part)
+		}
+		resolution, err := ParseSpan(res)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tier %q: %w", part, err)
+		}
+		retention, err := ParseSpan(ret)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tier %q: %w", part, err)
+		}
+		if resolution < time.Second || resolution%time.Second != 0 {
+			return nil, fmt.Errorf("invalid tier %q: resolution must be a whole number of seconds", part)
+		}
+		if retention < resolution || retention%resolution != 0 {
+			return nil, fmt.Errorf("invalid tier %q: retention must be a multiple of the resolution", part)
+		}
+		tiers = append(tiers, Tier{Resolution: resolution, Retention: retention})
+	}
+
+	for i := 1; i < len(tiers); i++ {
+		if tiers[i].Resolution <= tiers[i-1].Resolution {
+			return nil, fmt.Errorf("tiers must be ordered from finest to coarsest resolution")
+		}
+	}
+	return tiers, nil
+}
+
+var spanUnits = []struct {
+	suffix string
+	unit   time.Duration
+}{
+	{"y", 365 * 24 * time.Hour},
+	{"w", 7 * 24 * time.Hour},
+	{"d", 24 * time.Hour},
+}
+
+// ParseSpan is time.ParseDuration extended with the d, w and y units,
+// which are the natural way to write retention periods.
+func ParseSpan(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	for _, u := range spanUnits {
+		if num, ok := strings.CutSuffix(s, u.suffix); ok {
+			n, err := strconv.ParseFloat(num, 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid duration %q", s)
+			}
+			return time.Duration(n * float64(u.unit)), nil
+		}
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return d, nil
+}
+
+// FormatSpan is the inverse of ParseSpan for whole units.
+func FormatSpan(d time.Duration) string {
+	for _, u := range spanUnits {
+		if d >= u.unit && d%u.unit == 0 {
+			return strconv.FormatInt(int64(d/u.unit), 10) + u.suffix
+		}
+	}
+	switch {
+	case d >= time.Hour && d%time.Hour == 0:
+		return strconv.FormatInt(int64(d/time.Hour), 10) + "h"
+	case d >= time.Minute && d%time.Minute == 0:
+		return strconv.FormatInt(int64(d/time.Minute), 10) + "m"
+	}
+	return d.String()
+}
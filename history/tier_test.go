@@ -0,0 +1,67 @@
+package history
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseTiers(t *testing.T) {
+	tests := []struct {
+		spec  string
+		tiers []Tier
+	}{
+		{"1s:1h,1m:7d,1h:365d", []Tier{
+			{time.Second, time.Hour},
+			{time.Minute, 7 * 24 * time.Hour},
+			{time.Hour, 365 * 24 * time.Hour},
+		}},
+		{" 10s:1d , 5m:2w ", []Tier{
+			{10 * time.Second, 24 * time.Hour},
+			{5 * time.Minute, 14 * 24 * time.Hour},
+		}},
+		{"1m:1y,", []Tier{{time.Minute, 365 * 24 * time.Hour}}},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		tiers, err := ParseTiers(tt.spec)
+		if err != nil {
+			t.Errorf("ParseTiers(%q): %v", tt.spec, err)
+			continue
+		}
+		if !reflect.DeepEqual(tiers, tt.tiers) {
+			t.Errorf("ParseTiers(%q) = %v, want %v", tt.spec, tiers, tt.tiers)
+		}
+	}
+}
+
+func TestParseTiersErrors(t *testing.T) {
+	for _, spec := range []string{
+		"1s",
+		"1s:forever",
+		"soon:1h",
+		"500ms:1h",
+		"1.5s:1h",
+		"1m:30s",
+		"7s:1m",
+		"1m:1d,1s:1h",
+		"1m:1d,1m:7d",
+	} {
+		if _, err := ParseTiers(spec); err == nil {
+			t.Errorf("ParseTiers(%q) succeeded", spec)
+		}
+	}
+}
+
+func TestFormatSpan(t *testing.T) {
+	for _, span := range []string{"1s", "1m30s", "5m", "36h", "1d", "2w", "1y"} {
+		d, err := ParseSpan(span)
+		if err != nil {
+			t.Errorf("ParseSpan(%q): %v", span, err)
+			continue
+		}
+		if got := FormatSpan(d); got != span {
+			t.Errorf("FormatSpan(ParseSpan(%q)) = %q", span, got)
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"bufio"
+	"crypto/tls"
 	"embed"
 	"flag"
 	"fmt"
@@ -8,9 +10,15 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
+	"netron/certs"
 	"netron/cmdtools"
 	"netron/handlers"
+	"netron/history"
+	"netron/models"
 
 	"github.com/gorilla/mux"
 )
@@ -22,6 +30,45 @@ func main() {
 	run := flag.Bool("run", false, "Run the server")
 	port := flag.String("port", "8080", "Port to run server on")
 	removeDeps := flag.Bool("remove-deps", false, "Remove installed dependencies")
+	dataDir := flag.String("data-dir", "netron-data", "Directory for persistent data")
+	stBackend := flag.String("speedtest-backend", handlers.BackendNative, "Default speed test backend: native, speedtest-cli, ookla or iperf3")
+	stURL := flag.String("speedtest-url", handlers.DefaultSpeedTestURL, "Server used by the native speed test backend")
+	stServers := flag.String("speedtest-servers", "", "Comma separated further servers a native speed test run may choose")
+	stStreams := flag.Int("speedtest-streams", 4, "Parallel streams used by the native speed test backend")
+	stDuration := flag.Duration("speedtest-duration", 10*time.Second, "Duration of each native download and upload phase")
+	stTimeout := flag.Duration("speedtest-timeout", handlers.DefaultSpeedTestTimeout, "Stop speed tests that run longer than this (0 for no limit)")
+	stServe := flag.Bool("speedtest-serve", false, "Serve /speedtest/__down and /speedtest/__up as a target for other Netrons' native speed tests")
+	iperf3Server := flag.String("iperf3-server", "", "Default host[:port] for the iperf3 speed test backend")
+	peerServer := flag.String("peer-server", "", "Default host[:port] of another Netron for the peer speed test backend")
+	peerSecret := flag.String("peer-secret", "", "Shared secret required by the peer server and sent by the peer backend")
+	peerMaxBandwidth := flag.Float64("peer-max-bandwidth", handlers.DefaultPeerMaxBandwidth, "Highest UDP rate in Mbit/s the peer server sends or accepts")
+	peerPort := flag.Int("peer-port", 0, "Accept peer throughput tests on this TCP/UDP port (0 to disable)")
+	stInterval := flag.String("speedtest-interval", "", "Run a speed test at a fixed interval, e.g. 6h")
+	stCron := flag.String("speedtest-cron", "", "Run speed tests on a cron schedule, e.g. \"0 */4 * * *\"")
+	stJitter := flag.String("speedtest-jitter", "", "Random delay added to each scheduled speed test, e.g. 5m")
+	stQuiet := flag.String("speedtest-quiet-hours", "", "Skip scheduled speed tests in this local time window, e.g. 23:00-06:00")
+	latencyTargets := flag.String("latency-targets", handlers.DefaultLatencyTargets, "Latency monitor targets as [name=][icmp|tcp:]address (empty to disable)")
+	latencyInterval := flag.Duration("latency-interval", time.Minute, "Time between latency monitor rounds")
+	latencyCount := flag.Int("latency-count", 10, "Probes sent to each latency target per round")
+	checkIPv4 := flag.String("check-ipv4", handlers.DefaultReachabilityIPv4, "IPv4 addresses used to check connectivity (empty to disable)")
+	checkIPv6 := flag.String("check-ipv6", handlers.DefaultReachabilityIPv6, "IPv6 addresses used to check connectivity (empty to disable)")
+	checkName := flag.String("check-dns-name", handlers.DefaultReachabilityName, "Name resolved through the check addresses when ICMP and TCP fail")
+	checkInterval := flag.Duration("check-interval", 30*time.Second, "Time between connectivity checks")
+	geoDBs := flag.String("geoip-db", "", "Comma separated MaxMind DB files for geo/ASN lookups (default: *.mmdb in the data directory)")
+	geoProvider := flag.String("geoip-provider", "", "Online provider asked what local data cannot tell: ipinfo, ip-api, ifconfig.co or a URL (default: none)")
+	geoFields := flag.String("geoip-provider-fields", "", "JSON paths of a custom provider URL, e.g. ip=query,org=as,city=city")
+	geoTTL := flag.Duration("geoip-ttl", time.Hour, "How long public addresses and location are cached")
+	enrich := flag.Bool("enrich-connections", false, "Add reverse DNS, country and ASN to remote connection addresses")
+	enrichRate := flag.Int("enrich-rate", 10, "Maximum remote address lookups per second")
+	talkersInterval := flag.Duration("talkers-interval", 5*time.Second, "Time between top talker samples of the TCP sockets (0 to disable)")
+	tlsCert := flag.String("tls-cert", "", "Serve HTTPS with this PEM certificate (reloaded on SIGHUP or when it changes)")
+	tlsKey := flag.String("tls-key", "", "PEM private key of --tls-cert")
+	tlsSelfSigned := flag.Bool("tls-self-signed", false, "Serve HTTPS with a self-signed certificate kept in the data directory")
+	authFile := flag.String("auth-file", "", "File of users and API tokens allowed to use the dashboard and API (empty disables authentication)")
+	sessionTTL := flag.Duration("session-ttl", handlers.DefaultSessionTTL, "Lifetime of dashboard login sessions")
+	hashPassword := flag.Bool("hash-password", false, "Read a password from standard input and print its bcrypt hash for the auth file")
+	captureToken := flag.String("capture-token", "", "Bearer token required by the packet capture endpoint (empty disables capture)")
+	historyTiers := flag.String("history", "1s:1h,1m:7d,1h:365d", "History tiers as resolution:retention pairs (empty to disable)")
 
 	flag.StringVar(port, "p", "8080", "Port to run server on (shorthand)")
 	flag.Parse()
@@ -31,23 +78,232 @@ func main() {
 		os.Exit(0)
 	}
 
+	if *hashPassword {
+		password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && password == "" {
+			log.Fatalf("Failed to read the password: %v", err)
+		}
+		hash, err := handlers.HashPassword(strings.TrimRight(password, "\r\n"))
+		if err != nil {
+			log.Fatalf("Failed to hash the password: %v", err)
+		}
+		fmt.Println(hash)
+		os.Exit(0)
+	}
+
 	if !*run {
 		fmt.Println("Usage:")
-		fmt.Println("  --run              : Run the server (prompts for dependency install if needed)")
-		fmt.Println("  --remove-deps      : Remove dependencies")
-		fmt.Println("  --port or -p [port]: Specify port (default: 8080)")
+		fmt.Println("  --run                            : Run the server")
+		fmt.Println("  --remove-deps                    : Remove dependencies")
+		fmt.Println("  --port or -p [port]              : Specify port (default: 8080)")
+		fmt.Println("  --data-dir [dir]                 : Directory for persistent data (default: netron-data)")
+		fmt.Println("  --history [tiers]                : History tiers, e.g. 1s:1h,1m:7d,1h:365d (empty to disable)")
+		fmt.Println("  --speedtest-backend [name]       : native (default), speedtest-cli (prompts for install), ookla or iperf3")
+		fmt.Println("  --speedtest-url [url]            : Server for the native backend (default: https://speed.cloudflare.com)")
+		fmt.Println("  --speedtest-servers [urls]       : Further servers a native run may choose with \"server\"")
+		fmt.Println("  --speedtest-streams [n]          : Parallel streams for the native backend (default: 4)")
+		fmt.Println("  --speedtest-duration [dur]       : Length of each native transfer phase (default: 10s)")
+		fmt.Println("  --speedtest-timeout [dur]        : Stop speed tests running longer than this (default: 5m, 0 for no limit)")
+		fmt.Println("  --speedtest-serve                : Be a native speed test target for other Netron instances")
+		fmt.Println("  --iperf3-server [host:port]      : Default server for the iperf3 backend")
+		fmt.Println("  --peer-server [host:port]        : Default Netron instance for the peer backend")
+		fmt.Println("  --peer-port [port]               : Accept peer throughput tests on this port (e.g. 5301)")
+		fmt.Println("  --peer-secret [secret]           : Shared secret between peer servers and clients")
+		fmt.Println("  --peer-max-bandwidth [mbps]      : Highest UDP rate the peer server allows (default: 1000)")
+		fmt.Println("  --speedtest-interval [dur]       : Run speed tests at a fixed interval, e.g. 6h")
+		fmt.Println("  --speedtest-cron [expr]          : Run speed tests on a cron schedule, e.g. \"0 */4 * * *\"")
+		fmt.Println("  --speedtest-jitter [dur]         : Random delay added to scheduled speed tests")
+		fmt.Println("  --speedtest-quiet-hours [window] : Skip scheduled speed tests, e.g. 23:00-06:00")
+		fmt.Println("  --check-ipv4 [list]              : IPv4 connectivity check addresses (default: 8.8.8.8,1.1.1.1)")
+		fmt.Println("  --check-ipv6 [list]              : IPv6 connectivity check addresses (default: Google and Cloudflare DNS)")
+		fmt.Println("  --check-dns-name [name]          : Name resolved by the DNS connectivity check (default: google.com)")
+		fmt.Println("  --check-interval [dur]           : Time between connectivity checks (default: 30s)")
+		fmt.Println("  --geoip-db [files]               : MaxMind DB files for geo/ASN (default: *.mmdb in the data directory)")
+		fmt.Println("  --geoip-provider [name|url]      : Online fallback: ipinfo, ip-api, ifconfig.co or a custom URL (default: none)")
+		fmt.Println("  --geoip-provider-fields [map]    : JSON paths for a custom URL, e.g. ip=query,org=as,city=city")
+		fmt.Println("  --geoip-ttl [dur]                : Cache lifetime of public addresses and location (default: 1h)")
+		fmt.Println("  --enrich-connections             : Add reverse DNS, country and ASN to connection remote addresses")
+		fmt.Println("  --enrich-rate [n]                : Maximum remote address lookups per second (default: 10)")
+		fmt.Println("  --talkers-interval [dur]         : Time between top talker samples (default: 5s, 0 to disable)")
+		fmt.Println("  --tls-cert [file]                : Serve HTTPS with this certificate, reloaded on SIGHUP or change")
+		fmt.Println("  --tls-key [file]                 : Private key of --tls-cert")
+		fmt.Println("  --tls-self-signed                : Serve HTTPS with a self-signed certificate stored in the data directory")
+		fmt.Println("  --auth-file [file]               : Require login with the users and API tokens in this file")
+		fmt.Println("  --session-ttl [dur]              : Lifetime of dashboard login sessions (default: 24h)")
+		fmt.Println("  --hash-password                  : Print the bcrypt hash of a password read from standard input")
+		fmt.Println("  --capture-token [token]          : Enable packet capture for clients presenting this bearer token")
+		fmt.Println("  --latency-targets [list]         : Latency monitor targets, e.g. gw=icmp:192.168.1.1,tcp:example.com:443")
+		fmt.Println("  --latency-interval [dur]         : Time between latency monitor rounds (default: 1m)")
+		fmt.Println("  --latency-count [n]              : Probes per target and round (default: 10)")
 		os.Exit(1)
 	}
 
-	if !cmdtools.EnsureDependency() {
+	if *tlsSelfSigned {
+		if *tlsCert != "" || *tlsKey != "" {
+			log.Fatalf("--tls-self-signed cannot be combined with --tls-cert and --tls-key")
+		}
+		*tlsCert = filepath.Join(*dataDir, "tls", "cert.pem")
+		*tlsKey = filepath.Join(*dataDir, "tls", "key.pem")
+		created, err := certs.EnsureSelfSigned(*tlsCert, *tlsKey)
+		if err != nil {
+			log.Fatalf("Failed to create a self-signed certificate: %v", err)
+		}
+		if created {
+			fmt.Printf("Created a self-signed certificate in %s\n", filepath.Dir(*tlsCert))
+		}
+	}
+	if (*tlsCert == "") != (*tlsKey == "") {
+		log.Fatalf("--tls-cert and --tls-key must be given together")
+	}
+
+	if err := handlers.StartAuth(handlers.AuthConfig{File: *authFile, SessionTTL: *sessionTTL}); err != nil {
+		log.Fatalf("Invalid authentication configuration: %v", err)
+	}
+
+	var nativeServers []string
+	if *stServers != "" {
+		nativeServers = strings.Split(*stServers, ",")
+	}
+	err := handlers.ConfigureSpeedTest(handlers.SpeedTestConfig{
+		Backend: *stBackend,
+		Timeout: *stTimeout,
+		Native: handlers.NativeSpeedTestConfig{
+			URL:      *stURL,
+			Servers:  nativeServers,
+			Streams:  *stStreams,
+			Duration: *stDuration,
+		},
+		Iperf3Server: *iperf3Server,
+		PeerServer:   *peerServer,
+		PeerSecret:   *peerSecret,
+	})
+	if err != nil {
+		log.Fatalf("Invalid speed test configuration: %v", err)
+	}
+
+	if *stBackend == handlers.BackendSpeedtestCLI && !cmdtools.EnsureDependency() {
 		os.Exit(1)
 	}
 
+	if *peerPort != 0 {
+		err := handlers.StartPeerServer(handlers.PeerServerConfig{
+			Port:         *peerPort,
+			Secret:       *peerSecret,
+			MaxBandwidth: *peerMaxBandwidth,
+		})
+		if err != nil {
+			log.Fatalf("Failed to start peer server: %v", err)
+		}
+		fmt.Printf("Accepting peer throughput tests on :%d\n", *peerPort)
+	}
+
+	if *historyTiers != "" {
+		tiers, err := history.ParseTiers(*historyTiers)
+		if err != nil {
+			log.Fatalf("Invalid --history: %v", err)
+		}
+		store, err := history.Open(filepath.Join(*dataDir, "history"), tiers)
+		if err != nil {
+			log.Fatalf("Failed to open history store: %v", err)
+		}
+		handlers.StartHistory(store)
+	}
+
+	geoFiles, _ := filepath.Glob(filepath.Join(*dataDir, "*.mmdb"))
+	if *geoDBs != "" {
+		geoFiles = strings.Split(*geoDBs, ",")
+	}
+	err = handlers.StartGeo(handlers.GeoConfig{
+		Databases:      geoFiles,
+		Provider:       *geoProvider,
+		ProviderFields: *geoFields,
+		TTL:            *geoTTL,
+	})
+	if err != nil {
+		log.Fatalf("Invalid geo configuration: %v", err)
+	}
+
+	if err := handlers.StartEnrichment(handlers.EnrichConfig{Enabled: *enrich, Rate: *enrichRate}); err != nil {
+		log.Fatalf("Invalid connection enrichment configuration: %v", err)
+	}
+
+	if err := handlers.ConfigureCapture(handlers.CaptureConfig{Token: *captureToken}); err != nil {
+		log.Fatalf("Invalid packet capture configuration: %v", err)
+	}
+
+	handlers.StartNetStats()
+	handlers.StartListenerScans()
+
+	if err := handlers.StartTopTalkers(handlers.TalkersConfig{Interval: *talkersInterval}); err != nil {
+		log.Fatalf("Invalid top talkers configuration: %v", err)
+	}
+
+	err = handlers.StartReachabilityChecks(handlers.ReachabilityConfig{
+		IPv4:     *checkIPv4,
+		IPv6:     *checkIPv6,
+		DNSName:  *checkName,
+		Interval: *checkInterval,
+	})
+	if err != nil {
+		log.Fatalf("Invalid connectivity check configuration: %v", err)
+	}
+
+	err = handlers.StartLatencyMonitor(handlers.LatencyConfig{
+		Targets:  *latencyTargets,
+		Interval: *latencyInterval,
+		Count:    *latencyCount,
+	})
+	if err != nil {
+		log.Fatalf("Invalid latency monitor configuration: %v", err)
+	}
+
+	if err := handlers.OpenSpeedTestHistory(filepath.Join(*dataDir, "speedtest.jsonl")); err != nil {
+		log.Printf("Speed test history unavailable: %v", err)
+	}
+
+	schedule := models.SpeedTestSchedule{
+		Enabled:    *stInterval != "" || *stCron != "",
+		Interval:   *stInterval,
+		Cron:       *stCron,
+		Jitter:     *stJitter,
+		QuietHours: *stQuiet,
+	}
+	if err := handlers.StartSpeedTestScheduler(schedule); err != nil {
+		log.Fatalf("Invalid speed test schedule: %v", err)
+	}
+
 	r := mux.NewRouter()
+	r.Use(handlers.RequireAuth)
+
+	r.HandleFunc("/api/login", handlers.Login).Methods("POST")
+	r.HandleFunc("/api/logout", handlers.Logout).Methods("POST")
+	r.HandleFunc("/api/me", handlers.GetCurrentUser).Methods("GET")
 
 	r.HandleFunc("/api/system", handlers.GetSystemInfo).Methods("GET")
 	r.HandleFunc("/api/speedtest", handlers.GetSpeedTest).Methods("GET")
-	r.HandleFunc("/api/speedtest/start", handlers.StartSpeedTest).Methods("POST")
+	r.HandleFunc("/api/speedtest", handlers.RequirePermission(handlers.ActionRunSpeedTest, handlers.CancelSpeedTest)).Methods("DELETE")
+	r.HandleFunc("/api/speedtest/start", handlers.RequirePermission(handlers.ActionRunSpeedTest, handlers.StartSpeedTest)).Methods("POST")
+	r.HandleFunc("/api/speedtest/events", handlers.StreamSpeedTest).Methods("GET")
+	r.HandleFunc("/api/speedtest/servers", handlers.GetSpeedTestServers).Methods("GET")
+	r.HandleFunc("/api/speedtest/schedule", handlers.GetSpeedTestSchedule).Methods("GET")
+	r.HandleFunc("/api/speedtest/schedule", handlers.RequirePermission(handlers.ActionScheduleSpeedTest, handlers.UpdateSpeedTestSchedule)).Methods("PUT")
+	r.HandleFunc("/api/speedtest/history", handlers.GetSpeedTestHistory).Methods("GET")
+	r.HandleFunc("/api/speedtest/history/summary", handlers.GetSpeedTestSummary).Methods("GET")
+	r.HandleFunc("/api/talkers", handlers.GetTopTalkers).Methods("GET")
+	r.HandleFunc("/api/capture", handlers.RequirePermission(handlers.ActionCapture, handlers.GetCapture)).Methods("GET")
+	r.HandleFunc("/api/netconfig", handlers.GetNetworkConfig).Methods("GET")
+	r.HandleFunc("/api/tuning", handlers.GetTuning).Methods("GET")
+	r.HandleFunc("/api/netstat", handlers.GetNetStats).Methods("GET")
+	r.HandleFunc("/api/listeners", handlers.GetListeners).Methods("GET")
+	r.HandleFunc("/api/conntrack", handlers.GetConntrack).Methods("GET")
+	r.HandleFunc("/api/latency", handlers.GetLatency).Methods("GET")
+	r.HandleFunc("/api/history", handlers.GetHistory).Methods("GET")
+	r.HandleFunc("/api/history/metrics", handlers.GetHistoryMetrics).Methods("GET")
+
+	if *stServe {
+		r.HandleFunc("/speedtest/__down", handlers.RequirePermission(handlers.ActionRunSpeedTest, handlers.SpeedTestDownload)).Methods("GET")
+		r.HandleFunc("/speedtest/__up", handlers.RequirePermission(handlers.ActionRunSpeedTest, handlers.SpeedTestUpload)).Methods("POST")
+	}
 
 	staticFS, err := fs.Sub(staticFiles, "static")
 	if err != nil {
@@ -55,6 +311,32 @@ func main() {
 	}
 	r.PathPrefix("/").Handler(http.FileServer(http.FS(staticFS)))
 
-	fmt.Printf("Server starting on :%s\n", *port)
-	log.Fatal(http.ListenAndServe(":"+*port, r))
+	server := &http.Server{Addr: ":" + *port, Handler: r}
+	if *tlsCert == "" {
+		fmt.Printf("Server starting on :%s\n", *port)
+		log.Fatal(server.ListenAndServe())
+	}
+
+	reloader, err := certs.NewReloader(*tlsCert, *tlsKey)
+	if err != nil {
+		log.Fatalf("Failed to load the TLS certificate: %v", err)
+	}
+	if *tlsSelfSigned {
+		reloader.KeepSelfSigned()
+	}
+	go reloader.Watch(10*time.Second, func(err error) {
+		if err != nil {
+			log.Printf("Keeping the current TLS certificate: %v", err)
+			return
+		}
+		log.Printf("Reloaded TLS certificate, valid until %s", reloader.Leaf().NotAfter.Format(time.RFC3339))
+	})
+	server.TLSConfig = &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+	leaf := reloader.Leaf()
+	fmt.Printf("Server starting on :%s with TLS, certificate valid until %s\n", *port, leaf.NotAfter.Format(time.RFC3339))
+	fmt.Printf("Certificate SHA-256 fingerprint: %s\n", certs.Fingerprint(leaf))
+	log.Fatal(server.ListenAndServeTLS("", ""))
 }
\ No newline at end of file
@@ -20,20 +20,31 @@ type CPUInfo struct {
 }
 
 type SystemDetails struct {
-    OS             string `json:"os"`
-    Kernel         string `json:"kernel"`
-    Arch           string `json:"arch"`
-    Uptime         string `json:"uptime"`
-    LoadAverage    string `json:"load_average"`
-    TCPCongestion  string `json:"tcp_cc"`
-    Virtualization string `json:"virtualization"`
-    IPv4Status     string `json:"ipv4_status"`
-    IPv6Status     string `json:"ipv6_status"`
-    Organization   string `json:"organization"`
-    Location       string `json:"location"`
-    Region         string `json:"region"`
-    TotalDisk      string `json:"total_disk"`
-    UsedDisk       string `json:"used_disk"`
+    OS             string              `json:"os"`
+    Kernel         string              `json:"kernel"`
+    Arch           string              `json:"arch"`
+    Uptime         string              `json:"uptime"`
+    LoadAverage    string              `json:"load_average"`
+    TCPCongestion  string              `json:"tcp_cc"`
+    Virtualization string              `json:"virtualization"`
+    IPv4Status     *ReachabilityStatus `json:"ipv4_status"`
+    IPv6Status     *ReachabilityStatus `json:"ipv6_status"`
+    PublicIPv4     string              `json:"public_ipv4"`
+    PublicIPv6     string              `json:"public_ipv6"`
+    Organization   string              `json:"organization"`
+    Location       string              `json:"location"`
+    Region         string              `json:"region"`
+    TotalDisk      string              `json:"total_disk"`
+    UsedDisk       string              `json:"used_disk"`
+}
+
+type ReachabilityStatus struct {
+    Reachable bool    `json:"reachable"`
+    Target    string  `json:"target,omitempty"`
+    Method    string  `json:"method,omitempty"`
+    RTT       float64 `json:"rtt,omitempty"`
+    Error     string  `json:"error,omitempty"`
+    Checked   string  `json:"checked"`
 }
 
 type MemoryInfo struct {
@@ -60,25 +71,361 @@ type NetworkInfo struct {
 }
 
 type InterfaceInfo struct {
-    Name      string `json:"name"`
-    BytesSent uint64 `json:"bytes_sent"`
-    BytesRecv uint64 `json:"bytes_recv"`
-    Speed     uint64 `json:"speed"`
+    Name      string         `json:"name"`
+    BytesSent uint64         `json:"bytes_sent"`
+    BytesRecv uint64         `json:"bytes_recv"`
+    Speed     uint64         `json:"speed"`
+    Kind      string         `json:"kind,omitempty"`
+    State     string         `json:"state,omitempty"`
+    MTU       int            `json:"mtu,omitempty"`
+    WireGuard *WireGuardInfo `json:"wireguard,omitempty"`
+}
+
+type WireGuardInfo struct {
+    Implementation string          `json:"implementation"`
+    PublicKey      string          `json:"public_key"`
+    ListenPort     int             `json:"listen_port,omitempty"`
+    Peers          []WireGuardPeer `json:"peers"`
+}
+
+type WireGuardPeer struct {
+    PublicKey       string   `json:"public_key"`
+    Endpoint        string   `json:"endpoint,omitempty"`
+    AllowedIPs      []string `json:"allowed_ips"`
+    LatestHandshake string   `json:"latest_handshake,omitempty"`
+    HandshakeAge    int64    `json:"handshake_age,omitempty"`
+    RxBytes         int64    `json:"rx_bytes"`
+    TxBytes         int64    `json:"tx_bytes"`
+    Keepalive       int      `json:"keepalive,omitempty"`
 }
 
 type Connection struct {
-    LocalAddr  string `json:"local_addr"`
-    RemoteAddr string `json:"remote_addr"`
-    Status     string `json:"status"`
-    PID        int    `json:"pid"`
+    LocalAddr  string       `json:"local_addr"`
+    RemoteAddr string       `json:"remote_addr"`
+    Status     string       `json:"status"`
+    PID        int          `json:"pid"`
+    Remote     *AddressInfo `json:"remote,omitempty"`
+}
+
+type AddressInfo struct {
+    Hostname string `json:"hostname,omitempty"`
+    Public   bool   `json:"public"`
+    Country  string `json:"country,omitempty"`
+    ASN      uint   `json:"asn,omitempty"`
+    Org      string `json:"org,omitempty"`
 }
 
 type SpeedTestInfo struct {
-    Running      bool    `json:"running"`
-    Download     float64 `json:"download"`
-    Upload       float64 `json:"upload"`
-    Ping         float64 `json:"ping"`
-    Server       string  `json:"server"`
-    LastUpdated  string  `json:"last_updated"`
-    Error        string  `json:"error,omitempty"`
-}
\ No newline at end of file
+    Running      bool              `json:"running"`
+    Backend      string            `json:"backend,omitempty"`
+    Download     float64           `json:"download"`
+    Upload       float64           `json:"upload"`
+    Ping         float64           `json:"ping"`
+    Jitter       float64           `json:"jitter"`
+    Server       string            `json:"server"`
+    ServerID     string            `json:"server_id,omitempty"`
+    LastUpdated  string            `json:"last_updated"`
+    Error        string            `json:"error,omitempty"`
+    Phase        string            `json:"phase,omitempty"`
+    Progress     float64           `json:"progress"`
+    CurrentSpeed float64           `json:"current_speed,omitempty"`
+    Samples      []SpeedTestSample `json:"samples,omitempty"`
+}
+
+type SpeedTestSample struct {
+    Phase   string  `json:"phase"`
+    Elapsed float64 `json:"elapsed"`
+    Speed   float64 `json:"speed"`
+}
+
+type HistoryPoint struct {
+    Time  int64   `json:"t"`
+    Value float64 `json:"v"`
+}
+
+type HistorySeries struct {
+    Metric string         `json:"metric"`
+    From   int64          `json:"from"`
+    To     int64          `json:"to"`
+    Step   int64          `json:"step"`
+    Points []HistoryPoint `json:"points"`
+}
+
+type HistoryTier struct {
+    Resolution string `json:"resolution"`
+    Retention  string `json:"retention"`
+}
+
+type HistoryMetrics struct {
+    Tiers   []HistoryTier `json:"tiers"`
+    Metrics []string      `json:"metrics"`
+}
+
+type SpeedTestResult struct {
+    ID          int64               `json:"id"`
+    Timestamp   string              `json:"timestamp"`
+    Trigger     string              `json:"trigger"`
+    Backend     string              `json:"backend,omitempty"`
+    Server      string              `json:"server"`
+    ServerID    string              `json:"server_id,omitempty"`
+    Ping        float64             `json:"ping"`
+    Jitter      float64             `json:"jitter"`
+    Download    float64             `json:"download"`
+    Upload      float64             `json:"upload"`
+    Protocol    string              `json:"protocol,omitempty"`
+    Retransmits int                 `json:"retransmits,omitempty"`
+    Loss        float64             `json:"loss,omitempty"`
+    Intervals   []SpeedTestInterval `json:"intervals,omitempty"`
+    Status      string              `json:"status,omitempty"`
+    Error       string              `json:"error,omitempty"`
+}
+
+type SpeedTestInterval struct {
+    Direction   string  `json:"direction"`
+    Start       float64 `json:"start"`
+    End         float64 `json:"end"`
+    Bytes       uint64  `json:"bytes"`
+    Bandwidth   float64 `json:"bandwidth"`
+    Retransmits int     `json:"retransmits,omitempty"`
+    Jitter      float64 `json:"jitter,omitempty"`
+    Packets     int     `json:"packets,omitempty"`
+    Lost        int     `json:"lost,omitempty"`
+}
+
+type SpeedTestHistory struct {
+    Total   int               `json:"total"`
+    Page    int               `json:"page"`
+    Limit   int               `json:"limit"`
+    Results []SpeedTestResult `json:"results"`
+}
+
+type SpeedTestStats struct {
+    Min float64 `json:"min"`
+    Avg float64 `json:"avg"`
+    Max float64 `json:"max"`
+    P95 float64 `json:"p95"`
+}
+
+type SpeedTestDaySummary struct {
+    Date     string         `json:"date"`
+    Runs     int            `json:"runs"`
+    Failures int            `json:"failures"`
+    Ping     SpeedTestStats `json:"ping"`
+    Jitter   SpeedTestStats `json:"jitter"`
+    Download SpeedTestStats `json:"download"`
+    Upload   SpeedTestStats `json:"upload"`
+}
+
+type SpeedTestRequest struct {
+    Backend   string   `json:"backend,omitempty"`
+    Server    string   `json:"server,omitempty"`
+    Exclude   []string `json:"exclude,omitempty"`
+    Protocol  string   `json:"protocol,omitempty"`
+    Duration  int      `json:"duration,omitempty"`
+    Bandwidth float64  `json:"bandwidth,omitempty"`
+}
+
+type SpeedTestServer struct {
+    ID       string  `json:"id"`
+    Name     string  `json:"name"`
+    Location string  `json:"location"`
+    Country  string  `json:"country"`
+    Host     string  `json:"host,omitempty"`
+    Distance float64 `json:"distance,omitempty"`
+    Latency  float64 `json:"latency,omitempty"`
+}
+
+type SpeedTestServerList struct {
+    Backend string            `json:"backend"`
+    Servers []SpeedTestServer `json:"servers"`
+}
+
+type SpeedTestSchedule struct {
+    Enabled    bool   `json:"enabled"`
+    Backend    string `json:"backend,omitempty"`
+    Interval   string `json:"interval,omitempty"`
+    Cron       string `json:"cron,omitempty"`
+    Jitter     string `json:"jitter,omitempty"`
+    QuietHours string `json:"quiet_hours,omitempty"`
+    NextRun    string `json:"next_run,omitempty"`
+}
+
+
+type LatencyRound struct {
+    Timestamp string  `json:"timestamp"`
+    Sent      int     `json:"sent"`
+    Received  int     `json:"received"`
+    Loss      float64 `json:"loss"`
+    Min       float64 `json:"min"`
+    Avg       float64 `json:"avg"`
+    Median    float64 `json:"median"`
+    Max       float64 `json:"max"`
+    Jitter    float64 `json:"jitter"`
+    Error     string  `json:"error,omitempty"`
+}
+
+type LatencyTarget struct {
+    Name     string         `json:"name"`
+    Method   string         `json:"method"`
+    Address  string         `json:"address"`
+    Resolved string         `json:"resolved,omitempty"`
+    Metric   string         `json:"metric"`
+    Last     *LatencyRound  `json:"last,omitempty"`
+    Rounds   []LatencyRound `json:"rounds"`
+}
+
+type TalkerFlow struct {
+    Local   string  `json:"local"`
+    Remote  string  `json:"remote"`
+    PID     int     `json:"pid,omitempty"`
+    Process string  `json:"process,omitempty"`
+    RxRate  float64 `json:"rx_rate"`
+    TxRate  float64 `json:"tx_rate"`
+}
+
+type Talker struct {
+    Name   string       `json:"name"`
+    PID    int          `json:"pid,omitempty"`
+    Flows  int          `json:"flows"`
+    RxRate float64      `json:"rx_rate"`
+    TxRate float64      `json:"tx_rate"`
+    Remote *AddressInfo `json:"remote,omitempty"`
+}
+
+type TopTalkers struct {
+    Timestamp string       `json:"timestamp"`
+    Interval  float64      `json:"interval"`
+    Hosts     []Talker     `json:"hosts"`
+    Processes []Talker     `json:"processes"`
+    Flows     []TalkerFlow `json:"flows"`
+}
+
+type ConntrackTuple struct {
+    Src     string `json:"src"`
+    Dst     string `json:"dst"`
+    SrcPort int    `json:"sport,omitempty"`
+    DstPort int    `json:"dport,omitempty"`
+    Packets uint64 `json:"packets,omitempty"`
+    Bytes   uint64 `json:"bytes,omitempty"`
+}
+
+type ConntrackFlow struct {
+    Family    string         `json:"family"`
+    Protocol  string         `json:"protocol"`
+    State     string         `json:"state,omitempty"`
+    Timeout   int            `json:"timeout"`
+    Original  ConntrackTuple `json:"original"`
+    Reply     ConntrackTuple `json:"reply"`
+    NAT       string         `json:"nat,omitempty"`
+    Assured   bool           `json:"assured"`
+    Unreplied bool           `json:"unreplied"`
+    Mark      uint64         `json:"mark,omitempty"`
+}
+
+type ConntrackTable struct {
+    Count     int             `json:"count"`
+    Max       int             `json:"max"`
+    Usage     float64         `json:"usage"`
+    Entries   int             `json:"entries"`
+    NAT       int             `json:"nat"`
+    Matched   int             `json:"matched"`
+    Protocols map[string]int  `json:"protocols"`
+    States    map[string]int  `json:"states"`
+    Flows     []ConntrackFlow `json:"flows"`
+}
+
+type Listener struct {
+    Protocol  string `json:"protocol"`
+    Family    string `json:"family"`
+    Address   string `json:"address"`
+    Port      int    `json:"port"`
+    UID       int    `json:"uid"`
+    PID       int    `json:"pid,omitempty"`
+    Process   string `json:"process,omitempty"`
+    Exe       string `json:"exe,omitempty"`
+    Unit      string `json:"unit,omitempty"`
+    Runtime   string `json:"runtime,omitempty"`
+    Container string `json:"container,omitempty"`
+}
+
+type ListenerInventory struct {
+    Timestamp string     `json:"timestamp"`
+    Since     string     `json:"since"`
+    Listeners []Listener `json:"listeners"`
+    Added     []Listener `json:"added"`
+    Removed   []Listener `json:"removed"`
+}
+
+type NetCounter struct {
+    Name        string   `json:"name"`
+    Value       int64    `json:"value"`
+    Rate        *float64 `json:"rate,omitempty"`
+    Gauge       bool     `json:"gauge,omitempty"`
+    Description string   `json:"description,omitempty"`
+}
+
+type NetStats struct {
+    Timestamp         string       `json:"timestamp"`
+    Interval          float64      `json:"interval"`
+    TCPCongestion     string       `json:"tcp_cc"`
+    RetransmitPercent *float64     `json:"retransmit_percent,omitempty"`
+    Counters          []NetCounter `json:"counters"`
+}
+
+type TuningSetting struct {
+    Name        string `json:"name"`
+    Value       string `json:"value"`
+    Description string `json:"description"`
+    Recommended string `json:"recommended,omitempty"`
+    Status      string `json:"status,omitempty"`
+    Note        string `json:"note,omitempty"`
+}
+
+type TuningReport struct {
+    Profile      string          `json:"profile"`
+    Profiles     []string        `json:"profiles"`
+    BBRAvailable bool            `json:"bbr_available"`
+    Deviations   int             `json:"deviations"`
+    Settings     []TuningSetting `json:"settings"`
+}
+
+type Route struct {
+    Family      string `json:"family"`
+    Destination string `json:"destination"`
+    Gateway     string `json:"gateway,omitempty"`
+    Interface   string `json:"interface"`
+    Metric      int    `json:"metric"`
+    MTU         int    `json:"mtu,omitempty"`
+    Default     bool   `json:"default"`
+}
+
+type Neighbor struct {
+    Family    string `json:"family"`
+    IP        string `json:"ip"`
+    MAC       string `json:"mac,omitempty"`
+    Interface string `json:"interface"`
+    State     string `json:"state"`
+    Router    bool   `json:"router"`
+}
+
+type DNSConfig struct {
+    Nameservers []string `json:"nameservers"`
+    Search      []string `json:"search,omitempty"`
+    Options     []string `json:"options,omitempty"`
+    Upstream    []string `json:"upstream,omitempty"`
+}
+
+type NetworkConfig struct {
+    Routes    []Route    `json:"routes"`
+    Gateways  []Route    `json:"gateways"`
+    Neighbors []Neighbor `json:"neighbors"`
+    DNS       DNSConfig  `json:"dns"`
+    Error     string     `json:"error,omitempty"`
+}
+
+type CurrentUser struct {
+    User        string   `json:"user,omitempty"`
+    Role        string   `json:"role"`
+    Actions     []string `json:"actions"`
+    AuthEnabled bool     `json:"auth_enabled"`
+}
@@ -0,0 +1,66 @@
+package netlink
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+
+	"golang.org/x/sys/unix"
+)
+
+// Neighbor is an entry of the kernel's ARP (IPv4) or NDP (IPv6) cache.
+type Neighbor struct {
+	IP       netip.Addr
+	MAC      net.HardwareAddr
+	Ifindex  int
+	State    string
+	IsRouter bool
+}
+
+var neighborStates = []struct {
+	state uint16
+	name  string
+}{
+	{unix.NUD_INCOMPLETE, "incomplete"},
+	{unix.NUD_REACHABLE, "reachable"},
+	{unix.NUD_STALE, "stale"},
+	{unix.NUD_DELAY, "delay"},
+	{unix.NUD_PROBE, "probe"},
+	{unix.NUD_FAILED, "failed"},
+	{unix.NUD_NOARP, "noarp"},
+	{unix.NUD_PERMANENT, "permanent"},
+}
+
+// Neighbors lists the neighbour cache of both address families.
+func Neighbors() ([]Neighbor, error) {
+	var neighbors []Neighbor
+	req := make([]byte, unix.SizeofNdMsg) // AF_UNSPEC dumps both families
+	err := Dump(unix.NETLINK_ROUTE, unix.RTM_GETNEIGH, req, func(data []byte) {
+		if len(data) < unix.SizeofNdMsg {
+			return
+		}
+		attrs := attributes(data[unix.SizeofNdMsg:])
+		ip, ok := netip.AddrFromSlice(attrs[unix.NDA_DST])
+		if !ok {
+			return
+		}
+		n := Neighbor{
+			IP:       ip.Unmap(),
+			Ifindex:  int(int32(binary.NativeEndian.Uint32(data[4:]))),
+			State:    "none",
+			IsRouter: data[10]&unix.NTF_ROUTER != 0,
+		}
+		if mac := attrs[unix.NDA_LLADDR]; len(mac) > 0 {
+			n.MAC = append(net.HardwareAddr{}, mac...)
+		}
+		state := binary.NativeEndian.Uint16(data[8:])
+		for _, s := range neighborStates {
+			if state&s.state != 0 {
+				n.State = s.name
+				break
+			}
+		}
+		neighbors = append(neighbors, n)
+	})
+	return neighbors, err
+}
@@ -0,0 +1,89 @@
+package netlink
+
+import (
+	"encoding/binary"
+	"net/netip"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	inetDiagInfo = 2
+
+	sizeofInetDiagReqV2 = 56
+	sizeofInetDiagMsg   = 72
+
+	// Offsets of the byte counters in struct tcp_info, present since
+	// Linux 4.1 and 4.2.
+	tcpInfoBytesAcked    = 120
+	tcpInfoBytesReceived = 128
+)
+
+// TCPSocket is one TCP socket as reported by the sock_diag interface.
+// BytesAcked and BytesReceived are only set when HasBytes is true.
+type TCPSocket struct {
+	State         uint8
+	Local         netip.AddrPort
+	Remote        netip.AddrPort
+	UID           uint32
+	Inode         uint32
+	Cookie        uint64
+	BytesAcked    uint64
+	BytesReceived uint64
+	HasBytes      bool
+}
+
+// TCPSockets lists the IPv4 and IPv6 TCP sockets of the host's network
+// namespace with their tcp_info byte counters.
+func TCPSockets() ([]TCPSocket, error) {
+	var sockets []TCPSocket
+	for _, family := range []uint8{unix.AF_INET, unix.AF_INET6} {
+		req := make([]byte, sizeofInetDiagReqV2)
+		req[0] = family
+		req[1] = unix.IPPROTO_TCP
+		req[2] = 1 << (inetDiagInfo - 1)
+		binary.NativeEndian.PutUint32(req[4:], 0xffffffff) // every state
+
+		err := Dump(unix.NETLINK_SOCK_DIAG, unix.SOCK_DIAG_BY_FAMILY, req, func(data []byte) {
+			if s, ok := parseInetDiagMsg(data); ok {
+				sockets = append(sockets, s)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return sockets, nil
+}
+
+// parseInetDiagMsg decodes a struct inet_diag_msg and its attributes.
+// Ports and addresses in the embedded inet_diag_sockid are big endian.
+func parseInetDiagMsg(b []byte) (TCPSocket, bool) {
+	if len(b) < sizeofInetDiagMsg {
+		return TCPSocket{}, false
+	}
+	family := b[0]
+	s := TCPSocket{
+		State:  b[1],
+		UID:    binary.NativeEndian.Uint32(b[64:]),
+		Inode:  binary.NativeEndian.Uint32(b[68:]),
+		Cookie: uint64(binary.NativeEndian.Uint32(b[44:])) | uint64(binary.NativeEndian.Uint32(b[48:]))<<32,
+	}
+	sport := binary.BigEndian.Uint16(b[4:])
+	dport := binary.BigEndian.Uint16(b[6:])
+	src, dst := b[8:24], b[24:40]
+	if family == unix.AF_INET {
+		s.Local = netip.AddrPortFrom(netip.AddrFrom4([4]byte(src[:4])), sport)
+		s.Remote = netip.AddrPortFrom(netip.AddrFrom4([4]byte(dst[:4])), dport)
+	} else {
+		s.Local = netip.AddrPortFrom(netip.AddrFrom16([16]byte(src)).Unmap(), sport)
+		s.Remote = netip.AddrPortFrom(netip.AddrFrom16([16]byte(dst)).Unmap(), dport)
+	}
+
+	if info, ok := attributes(b[sizeofInetDiagMsg:])[inetDiagInfo]; ok && len(info) >= tcpInfoBytesReceived+8 {
+		s.BytesAcked = binary.NativeEndian.Uint64(info[tcpInfoBytesAcked:])
+		s.BytesReceived = binary.NativeEndian.Uint64(info[tcpInfoBytesReceived:])
+		s.HasBytes = true
+	}
+	return s, true
+}
@@ -0,0 +1,34 @@
+package probe
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// DNS resolves name through the DNS server at address (host:port) over
+// network, "udp4" or "udp6", and returns the time taken. Any answer counts,
+// including one saying that name does not exist.
+func DNS(ctx context.Context, network, address, name string, timeout time.Duration) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, address)
+		},
+	}
+
+	start := time.Now()
+	_, err := resolver.LookupHost(ctx, name)
+	elapsed := time.Since(start)
+
+	var dnsErr *net.DNSError
+	if err != nil && !(errors.As(err, &dnsErr) && dnsErr.IsNotFound) {
+		return 0, err
+	}
+	return elapsed, nil
+}
@@ -0,0 +1,168 @@
+// Package probe measures round trip times to remote hosts without relying
+// on external binaries such as ping.
+package probe
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	icmpv4EchoRequest = 8
+	icmpv4EchoReply   = 0
+	icmpv6EchoRequest = 128
+	icmpv6EchoReply   = 129
+
+	echoHeaderLen = 8
+	echoTokenLen  = 8
+)
+
+var (
+	// ErrICMPNotPermitted is returned when neither an unprivileged ICMP
+	// socket nor a raw socket can be opened.
+	ErrICMPNotPermitted = errors.New("ICMP not permitted: allow it with net.ipv4.ping_group_range or grant CAP_NET_RAW")
+	ErrTimeout          = errors.New("no reply")
+)
+
+var echoSeq uint32
+
+// ICMP sends one echo request to ip and returns the time until the
+// matching reply. It uses an unprivileged datagram socket where the kernel
+// allows one and falls back to a raw socket.
+func ICMP(ctx context.Context, ip net.IP, timeout time.Duration) (time.Duration, error) {
+	v4 := ip.To4() != nil
+	conn, raw, err := listenICMP(v4)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	// The kernel replaces the identifier of echo requests sent over a
+	// datagram socket, so replies are matched on sequence and a random
+	// token in the payload instead.
+	seq := uint16(atomic.AddUint32(&echoSeq, 1))
+	token := make([]byte, echoTokenLen)
+	rand.Read(token)
+	id := uint16(os.Getpid())
+
+	request, reply := byte(icmpv4EchoRequest), byte(icmpv4EchoReply)
+	if !v4 {
+		request, reply = icmpv6EchoRequest, icmpv6EchoReply
+	}
+	msg := make([]byte, echoHeaderLen+echoTokenLen)
+	msg[0] = request
+	binary.BigEndian.PutUint16(msg[4:], id)
+	binary.BigEndian.PutUint16(msg[6:], seq)
+	copy(msg[echoHeaderLen:], token)
+	// The kernel fills in ICMPv6 checksums, ICMPv4 ones are ours to compute.
+	if v4 {
+		binary.BigEndian.PutUint16(msg[2:], checksum(msg))
+	}
+
+	var dst net.Addr = &net.UDPAddr{IP: ip}
+	if raw {
+		dst = &net.IPAddr{IP: ip}
+	}
+	start := time.Now()
+	if _, err := conn.WriteTo(msg, dst); err != nil {
+		return 0, err
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return 0, ctx.Err()
+			}
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				return 0, ErrTimeout
+			}
+			return 0, err
+		}
+		elapsed := time.Since(start)
+		if n < echoHeaderLen+echoTokenLen || buf[0] != reply {
+			continue
+		}
+		if binary.BigEndian.Uint16(buf[6:]) != seq || string(buf[echoHeaderLen:echoHeaderLen+echoTokenLen]) != string(token) {
+			continue
+		}
+		if !addrIP(from).Equal(ip) {
+			continue
+		}
+		return elapsed, nil
+	}
+}
+
+// listenICMP opens an ICMP socket for one address family. raw reports
+// whether it is a raw socket, which addresses its peers as *net.IPAddr.
+func listenICMP(v4 bool) (conn net.PacketConn, raw bool, err error) {
+	family, proto, network, address := unix.AF_INET, unix.IPPROTO_ICMP, "ip4:icmp", "0.0.0.0"
+	if !v4 {
+		family, proto, network, address = unix.AF_INET6, unix.IPPROTO_ICMPV6, "ip6:ipv6-icmp", "::"
+	}
+
+	fd, err := unix.Socket(family, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC|unix.SOCK_NONBLOCK, proto)
+	if err == nil {
+		f := os.NewFile(uintptr(fd), "icmp")
+		conn, err = net.FilePacketConn(f)
+		f.Close()
+		if err != nil {
+			return nil, false, err
+		}
+		return conn, false, nil
+	}
+	if !errors.Is(err, unix.EACCES) && !errors.Is(err, unix.EPERM) && !errors.Is(err, unix.EPROTONOSUPPORT) {
+		return nil, false, fmt.Errorf("ICMP socket: %w", err)
+	}
+
+	conn, err = net.ListenPacket(network, address)
+	if err != nil {
+		if errors.Is(err, os.ErrPermission) {
+			return nil, false, ErrICMPNotPermitted
+		}
+		return nil, false, err
+	}
+	return conn, true, nil
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.IPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+func checksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
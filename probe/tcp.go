@@ -0,0 +1,21 @@
+package probe
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// TCP returns the time taken to open a TCP connection to address, a
+// host:port pair whose host is already resolved.
+func TCP(ctx context.Context, address string, timeout time.Duration) (time.Duration, error) {
+	dialer := net.Dialer{Timeout: timeout}
+	start := time.Now()
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return 0, err
+	}
+	elapsed := time.Since(start)
+	conn.Close()
+	return elapsed, nil
+}
@@ -25,6 +25,7 @@ document.addEventListener('DOMContentLoaded', () => {
 
 class Dashboard {
     constructor() {
+        this.actions = null;
         this.init();
         this.startUpdates();
         this.initSpeedTest();
@@ -32,16 +33,54 @@ class Dashboard {
 
     init() {
         this.updateData();
+        this.loadUser();
+    }
+
+    async loadUser() {
+        try {
+            const response = await fetch('/api/me');
+            const me = await response.json();
+            if (me.auth_enabled && me.user) {
+                document.getElementById('logout-user').textContent = `Sign out ${me.user} (${me.role})`;
+                document.getElementById('logout-form').hidden = false;
+            }
+            this.actions = me.actions;
+            this.applyPermissions();
+        } catch (error) {
+            console.error('Failed to fetch the current user:', error);
+        }
+    }
+
+    can(action) {
+        return this.actions === null || this.actions.includes(action);
+    }
+
+    applyPermissions() {
+        const btn = document.getElementById('speedtest-btn');
+        if (!this.can('speedtest.run')) {
+            btn.disabled = true;
+            btn.title = 'Your role cannot run speed tests';
+        }
     }
 
     initSpeedTest() {
         const btn = document.getElementById('speedtest-btn');
-        btn.addEventListener('click', () => this.startSpeedTest());
+        btn.addEventListener('click', () => {
+            if (this.speedTestRunning) {
+                this.cancelSpeedTest();
+            } else {
+                this.startSpeedTest();
+            }
+        });
     }
 
     async updateData() {
         try {
             const response = await fetch('/api/system');
+            if (response.status === 401) {
+                window.location.href = '/login.html?next=' + encodeURIComponent(window.location.pathname);
+                return;
+            }
             const data = await response.json();
             this.updateUI(data);
         } catch (error) {
@@ -101,15 +140,36 @@ class Dashboard {
         interfaces.forEach(iface => {
             const row = document.createElement('tr');
             row.innerHTML = `
-                <td>${iface.name}</td>
+                <td></td>
                 <td>${this.formatBytes(iface.bytes_sent)}</td>
                 <td>${this.formatBytes(iface.bytes_recv)}</td>
                 <td>${this.formatSpeed(iface.speed)}</td>
             `;
+            row.cells[0].textContent = this.formatInterfaceName(iface);
+            if (iface.wireguard) {
+                row.cells[0].title = iface.wireguard.peers.map(peer =>
+                    `${peer.endpoint || 'no endpoint'} (${peer.allowed_ips.join(', ')}), ` +
+                    (peer.latest_handshake ? `handshake ${peer.handshake_age}s ago` : 'no handshake')
+                ).join('\n');
+            }
             tbody.appendChild(row);
         });
     }
 
+    formatInterfaceName(iface) {
+        const details = [];
+        if (iface.wireguard) {
+            const peers = iface.wireguard.peers.length;
+            details.push(`wireguard, ${peers} peer${peers === 1 ? '' : 's'}`);
+        } else if (iface.kind) {
+            details.push(iface.kind);
+        }
+        if (iface.state && iface.state !== 'up' && iface.state !== 'unknown') {
+            details.push(iface.state);
+        }
+        return details.length ? `${iface.name} (${details.join(', ')})` : iface.name;
+    }
+
     updateConnections(connections, tableId) {
         const tbody = document.getElementById(tableId);
         tbody.innerHTML = '';
@@ -118,14 +178,29 @@ class Dashboard {
             const row = document.createElement('tr');
             row.innerHTML = `
                 <td>${conn.local_addr}</td>
-                <td>${conn.remote_addr}</td>
+                <td></td>
                 <td>${conn.status}</td>
                 <td>${conn.pid || '-'}</td>
             `;
+            this.updateRemoteCell(row.cells[1], conn);
             tbody.appendChild(row);
         });
     }
 
+    updateRemoteCell(cell, conn) {
+        const remote = conn.remote;
+        cell.textContent = conn.remote_addr;
+        if (!remote) return;
+
+        if (remote.country) {
+            cell.textContent += ` [${remote.country}]`;
+        }
+        const details = [];
+        if (remote.hostname) details.push(remote.hostname);
+        if (remote.asn) details.push(`AS${remote.asn} ${remote.org || ''}`.trim());
+        cell.title = details.join('\n');
+    }
+
     formatBytes(bytes) {
         if (bytes === 0) return '0 B';
         const k = 1024;
@@ -157,6 +232,7 @@ class Dashboard {
 
         try {
             await fetch('/api/speedtest/start', { method: 'POST' });
+            this.watchSpeedTest();
         } catch (error) {
             console.error('Failed to start speed test:', error);
             btn.disabled = false;
@@ -164,17 +240,64 @@ class Dashboard {
         }
     }
 
+    async cancelSpeedTest() {
+        try {
+            await fetch('/api/speedtest', { method: 'DELETE' });
+        } catch (error) {
+            console.error('Failed to cancel speed test:', error);
+        }
+    }
+
+    watchSpeedTest() {
+        if (this.speedTestEvents) return;
+
+        this.speedTestEvents = new EventSource('/api/speedtest/events');
+        this.speedTestEvents.onmessage = (event) => {
+            const speedtest = JSON.parse(event.data);
+            this.updateSpeedTest(speedtest);
+            if (!speedtest.running) {
+                this.speedTestEvents.close();
+                this.speedTestEvents = null;
+            }
+        };
+        this.speedTestEvents.onerror = () => {
+            this.speedTestEvents.close();
+            this.speedTestEvents = null;
+        };
+    }
+
+    formatPhase(phase) {
+        const labels = {
+            starting: 'Starting',
+            selecting_server: 'Selecting server',
+            ping: 'Ping',
+            download: 'Download',
+            upload: 'Upload',
+        };
+        return labels[phase] || 'Running';
+    }
+
     updateSpeedTest(speedtest) {
         const btn = document.getElementById('speedtest-btn');
         
+        this.speedTestRunning = speedtest.running;
         if (speedtest.running) {
-            btn.disabled = true;
-            btn.textContent = 'Running...';
-        } else {
-            btn.disabled = false;
-            btn.textContent = 'Start Speed Test';
+            btn.disabled = !this.can('speedtest.run');
+            btn.title = btn.disabled ? 'Your role cannot cancel speed tests' : 'Click to cancel';
+            btn.textContent = `${this.formatPhase(speedtest.phase)}... ${Math.round(speedtest.progress || 0)}%`;
+            this.watchSpeedTest();
+
+            if (speedtest.current_speed && (speedtest.phase === 'download' || speedtest.phase === 'upload')) {
+                document.getElementById(`${speedtest.phase}-speed`).textContent = speedtest.current_speed.toFixed(2);
+            }
+            return;
         }
 
+        btn.disabled = false;
+        btn.title = '';
+        btn.textContent = 'Start Speed Test';
+        this.applyPermissions();
+
         if (speedtest.error) {
             document.getElementById('download-speed').textContent = 'Error';
             document.getElementById('upload-speed').textContent = 'Error';
@@ -196,6 +319,12 @@ class Dashboard {
             speedtest.last_updated ? `Last updated: ${new Date(speedtest.last_updated).toLocaleString()}` : '';
     }
 
+    formatReachability(status) {
+        if (!status) return '-';
+        if (!status.reachable) return '✗ Offline';
+        return `✓ Online (${status.rtt.toFixed(1)} ms ${status.method})`;
+    }
+
     updateSystemInfo(system, cpu) {
         document.getElementById('cpu-model').textContent = cpu.model || '-';
         document.getElementById('cpu-cores-detailed').textContent = 
@@ -218,8 +347,15 @@ class Dashboard {
         document.getElementById('load-avg').textContent = system.load_average || '-';
         document.getElementById('tcp-cc').textContent = system.tcp_cc || '-';
         document.getElementById('virt-info').textContent = system.virtualization || '-';
-        document.getElementById('ip-status').textContent = 
-            `${system.ipv4_status} / ${system.ipv6_status}`;
+        const ipStatus = document.getElementById('ip-status');
+        ipStatus.textContent =
+            `${this.formatReachability(system.ipv4_status)} / ${this.formatReachability(system.ipv6_status)}`;
+        ipStatus.title = [system.ipv4_status, system.ipv6_status]
+            .filter((status) => status && status.error)
+            .map((status) => `${status.target}: ${status.error}`)
+            .join('\n');
+        document.getElementById('public-ipv4').textContent = system.public_ipv4 || '-';
+        document.getElementById('public-ipv6').textContent = system.public_ipv6 || '-';
         document.getElementById('organization').textContent = system.organization || '-';
         document.getElementById('location').textContent = system.location || '-';
     }